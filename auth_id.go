@@ -0,0 +1,62 @@
+package vmess
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// AuthIDMatcher finds the key an AEAD auth ID was encrypted with.
+//
+// The auth ID is AES(cmdKey, timestamp || random || crc32), so no index can be
+// derived from it without trying every key. Instead, the expanded AES key
+// schedules are precomputed once per user, kept in a contiguous slice and
+// scanned completely on every lookup with branch-free selection, so the time
+// taken does not depend on whether, or at which position, a key matches.
+// Lookup is O(n) in the number of keys: every key is tried on every handshake.
+type AuthIDMatcher struct {
+	blocks []cipher.Block
+}
+
+func NewAuthIDMatcher(keys [][16]byte) (*AuthIDMatcher, error) {
+	blocks := make([]cipher.Block, 0, len(keys))
+	for _, key := range keys {
+		block, err := NewAuthIDCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return &AuthIDMatcher{blocks}, nil
+}
+
+func NewAuthIDCipher(cmdKey [16]byte) (cipher.Block, error) {
+	return aes.NewCipher(KDF(cmdKey[:], KDFSaltConstAuthIDEncryptionKey)[:16])
+}
+
+func (m *AuthIDMatcher) Len() int {
+	return len(m.blocks)
+}
+
+// Match returns the index of the key that decrypts authId to a valid checksum,
+// and writes the decrypted auth ID to decodedId.
+func (m *AuthIDMatcher) Match(authId []byte, decodedId *[16]byte) (index int, found bool) {
+	var matched int
+	index, matched = matchAuthID(m.blocks, authId, decodedId)
+	return index, matched == 1
+}
+
+func matchAuthID(blocks []cipher.Block, authId []byte, decodedId *[16]byte) (index int, matched int) {
+	var candidate [16]byte
+	for i, block := range blocks {
+		block.Decrypt(candidate[:], authId)
+		valid := subtle.ConstantTimeEq(int32(crc32.ChecksumIEEE(candidate[:12])), int32(binary.BigEndian.Uint32(candidate[12:])))
+		take := valid &^ matched
+		index = subtle.ConstantTimeSelect(take, i, index)
+		subtle.ConstantTimeCopy(take, decodedId[:], candidate[:])
+		matched |= valid
+	}
+	return
+}
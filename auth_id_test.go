@@ -0,0 +1,44 @@
+package vmess
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/sagernet/sing/common/buf"
+)
+
+func TestAuthIDMatcher(t *testing.T) {
+	t.Parallel()
+	keys := make([][16]byte, 16)
+	for i := range keys {
+		keys[i] = Key(uuid.Must(uuid.NewV4()))
+	}
+	matcher, err := NewAuthIDMatcher(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, key := range keys {
+		buffer := buf.NewSize(16)
+		AuthID(key, now, buffer)
+		var decodedId [16]byte
+		index, found := matcher.Match(buffer.Bytes(), &decodedId)
+		buffer.Release()
+		if !found || index != i {
+			t.Fatal("key ", i, " matched as ", index, " ", found)
+		}
+		if int64(binary.BigEndian.Uint64(decodedId[:8])) != now.Unix() {
+			t.Fatal("bad decoded timestamp for key ", i)
+		}
+	}
+	buffer := buf.NewSize(16)
+	defer buffer.Release()
+	AuthID(Key(uuid.Must(uuid.NewV4())), now, buffer)
+	var decodedId [16]byte
+	_, found := matcher.Match(buffer.Bytes(), &decodedId)
+	if found {
+		t.Fatal("matched an unknown key")
+	}
+}
@@ -105,6 +105,12 @@ func (c *Client) DialEarlyXUDPPacketConn(upstream net.Conn, destination M.Socksa
 	return NewXUDPConn(&clientConn{c.dialRaw(upstream, CommandMux, destination)}, destination)
 }
 
+// DialMuxConn returns a Mux.Cool connection for a MuxClient.
+func (c *Client) DialMuxConn(upstream net.Conn) (net.Conn, error) {
+	conn := &clientConn{c.dialRaw(upstream, CommandMux, M.Socksaddr{})}
+	return conn, conn.writeHandshake(nil)
+}
+
 type rawClientConn struct {
 	*Client
 	net.Conn
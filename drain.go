@@ -0,0 +1,61 @@
+package vmess
+
+import (
+	"io"
+	mRand "math/rand"
+	"net"
+	"time"
+)
+
+// DrainOptions makes the service keep reading a random amount of data from a rejected
+// connection before closing it, as v2ray-core does, so active probers can not learn
+// the header length from the moment the connection drops.
+type DrainOptions struct {
+	// MinBytes and MaxBytes bound the total number of bytes read from the connection, including the header.
+	MinBytes int
+	MaxBytes int
+	// MinTimeout and MaxTimeout bound the time spent draining.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+}
+
+const (
+	DefaultDrainMinBytes   = 16 + 38
+	DefaultDrainMaxBytes   = 16 + 38 + 3266 + 64
+	DefaultDrainMinTimeout = 2 * time.Second
+	DefaultDrainMaxTimeout = 10 * time.Second
+)
+
+func (o *DrainOptions) normalize() {
+	if o.MinBytes <= 0 {
+		o.MinBytes = DefaultDrainMinBytes
+	}
+	if o.MaxBytes < o.MinBytes {
+		o.MaxBytes = o.MinBytes + DefaultDrainMaxBytes - DefaultDrainMinBytes
+	}
+	if o.MinTimeout <= 0 {
+		o.MinTimeout = DefaultDrainMinTimeout
+	}
+	if o.MaxTimeout < o.MinTimeout {
+		o.MaxTimeout = o.MinTimeout + DefaultDrainMaxTimeout - DefaultDrainMinTimeout
+	}
+}
+
+func (o *DrainOptions) randomBytes() int {
+	return o.MinBytes + mRand.Intn(o.MaxBytes-o.MinBytes+1)
+}
+
+func (o *DrainOptions) randomTimeout() time.Duration {
+	return o.MinTimeout + time.Duration(mRand.Int63n(int64(o.MaxTimeout-o.MinTimeout)+1))
+}
+
+// drain reads from conn until the random byte budget, minus the alreadyRead bytes, or the random time budget is spent.
+func (o *DrainOptions) drain(conn net.Conn, alreadyRead int64) {
+	remaining := int64(o.randomBytes()) - alreadyRead
+	if remaining <= 0 {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(o.randomTimeout()))
+	_, _ = io.CopyN(io.Discard, conn, remaining)
+	_ = conn.SetReadDeadline(time.Time{})
+}
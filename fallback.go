@@ -0,0 +1,22 @@
+package vmess
+
+import (
+	"context"
+	"net"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// FallbackHandler receives connections that failed authentication.
+// The connection replays the bytes already consumed by the service before the rest of the stream,
+// so the fallback sees exactly what the client sent.
+type FallbackHandler interface {
+	NewFallbackConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, onClose N.CloseHandlerFunc)
+}
+
+type FallbackHandlerFunc func(ctx context.Context, conn net.Conn, source M.Socksaddr, onClose N.CloseHandlerFunc)
+
+func (f FallbackHandlerFunc) NewFallbackConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, onClose N.CloseHandlerFunc) {
+	f(ctx, conn, source, onClose)
+}
@@ -0,0 +1,20 @@
+package vmess
+
+import (
+	"context"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// RequestHook is called with every decoded request before it is dispatched to the handler,
+// including mux streams, whose metadata has MuxStream set.
+// It returns the context and destination to dispatch the request with, or an error to reject it.
+type RequestHook[U comparable] func(ctx context.Context, user U, metadata ConnMetadata) (context.Context, M.Socksaddr, error)
+
+// Route calls the hook, a nil hook accepts the request unchanged.
+func (h RequestHook[U]) Route(ctx context.Context, user U, metadata ConnMetadata) (context.Context, M.Socksaddr, error) {
+	if h == nil {
+		return ctx, metadata.Destination, nil
+	}
+	return h(ctx, user, metadata)
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/binary"
 	"io"
+	"math"
 	"net"
 	"os"
 	"sync"
@@ -19,7 +20,75 @@ import (
 	N "github.com/sagernet/sing/common/network"
 )
 
+var (
+	ErrMuxStreamLimit = E.New("too many streams in mux session")
+	ErrMuxStreamRate  = E.New("too many new streams in mux session")
+	// ErrMuxSessionTimeout is the cause of sessions closed by KeepAliveMaxMissed.
+	ErrMuxSessionTimeout = E.New("mux session timeout")
+)
+
+// muxFrameSize is the largest payload of the frames written by both sides.
+const muxFrameSize = 8192
+
+// MuxSessionConn is implemented by the connections of mux streams.
+type MuxSessionConn interface {
+	// SessionLastActivity returns the time the last frame of any stream was received in the session.
+	SessionLastActivity() time.Time
+}
+
+type MuxServerOptions struct {
+	// TrackStream is called for every new stream with a function that closes it with a cause,
+	// the returned function is called once the stream is closed.
+	// The stream is closed with OptionError if it returns an error.
+	TrackStream func(closer func(err error)) (untrack func(), err error)
+	// RouteStream is called for every new stream before it is dispatched, it returns the context and
+	// destination to dispatch the stream with, or an error to close the stream with OptionError.
+	RouteStream func(ctx context.Context, command byte, destination M.Socksaddr) (context.Context, M.Socksaddr, error)
+	// StreamStats is called for every new stream to create its payload statistics.
+	StreamStats func(command byte, destination M.Socksaddr) *ConnStats
+	// WrapConn and WrapPacketConn are called with the connection of every new stream before it is dispatched.
+	WrapConn       func(conn net.Conn) net.Conn
+	WrapPacketConn func(conn N.PacketConn) N.PacketConn
+	// RejectStream is called for every new stream closed with OptionError before it is dispatched,
+	// because of the session policy, RouteStream or TrackStream. The User of the error is nil.
+	RejectStream func(err *RejectError)
+	// IdleTimeout closes streams without traffic in either direction with ErrIdleTimeout.
+	IdleTimeout time.Duration
+	MuxPolicy
+}
+
+// MuxPolicy configures the resources of Mux.Cool sessions, it is shared by all sessions of a service.
+type MuxPolicy struct {
+	// StreamBufferSize is the number of bytes buffered for each stream until its handler reads them,
+	// the default is DefaultMuxStreamBufferSize. Once it is exceeded, packets of UDP streams are dropped
+	// and TCP streams are closed with ErrMuxBufferFull.
+	StreamBufferSize int
+	// MaxStreams is the maximum number of concurrent streams of a session.
+	MaxStreams int
+	// MaxNewStreamsPerSecond is the maximum number of streams a session can open per second.
+	MaxNewStreamsPerSecond int
+	// StreamIdleTimeout closes streams without traffic in either direction with ErrIdleTimeout,
+	// it overrides MuxServerOptions.IdleTimeout if set.
+	StreamIdleTimeout time.Duration
+	// KeepAliveInterval is the interval the server sends keepalive frames at.
+	KeepAliveInterval time.Duration
+	// KeepAliveMaxMissed closes sessions with ErrMuxSessionTimeout once no frame has been received
+	// for this number of keepalive intervals, zero to keep silent sessions open.
+	KeepAliveMaxMissed int
+}
+
+func muxCommand(network byte) byte {
+	if network == NetworkUDP {
+		return CommandUDP
+	}
+	return CommandTCP
+}
+
 func HandleMuxConnection(ctx context.Context, conn net.Conn, source M.Socksaddr, handler Handler) error {
+	return HandleMuxConnectionEx(ctx, conn, source, handler, MuxServerOptions{})
+}
+
+func HandleMuxConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, handler Handler, options MuxServerOptions) error {
 	ctx, cancel := context.WithCancelCause(ctx)
 	session := &serverSession{
 		ctx:          ctx,
@@ -27,13 +96,18 @@ func HandleMuxConnection(ctx context.Context, conn net.Conn, source M.Socksaddr,
 		conn:         conn,
 		directWriter: bufio.NewExtendedWriter(conn),
 		handler:      handler,
+		options:      options,
 		streams:      make(map[uint16]*serverStream),
 		writer:       std_bufio.NewWriter(conn),
 	}
+	session.updateActivity()
 	go func() {
 		<-ctx.Done()
-		session.cleanup(ctx.Err())
+		session.cleanup(context.Cause(ctx))
 	}()
+	if options.KeepAliveInterval > 0 {
+		go session.keepAliveLoop(cancel)
+	}
 	return session.recvLoop(cancel)
 }
 
@@ -43,33 +117,88 @@ type serverSession struct {
 	conn         net.Conn
 	directWriter N.ExtendedWriter
 	handler      Handler
+	options      MuxServerOptions
 	streamAccess sync.RWMutex
 	streams      map[uint16]*serverStream
 	writer       *std_bufio.Writer
 	writeAccess  sync.Mutex
 	writeRace    uint32
+	rateStart    time.Time
+	rateCount    int
+	lastActivity int64
 }
 
 type serverStream struct {
 	network     byte
 	destination M.Socksaddr
-	pipe        *io.PipeWriter
+	buffer      *muxBuffer
+	untrack     func()
+	stats       *ConnStats
+	idleTimer   *activityTimer
+	// readClosed and writeClosed are set once the client or the handler has closed its direction of a TCP stream,
+	// the stream is removed once both are set.
+	readClosed  bool
+	writeClosed atomic.Bool
+}
+
+func (s *serverStream) closeWithError(err error) {
+	s.buffer.closeWithError(err)
+	s.idleTimer.stop()
+	if s.untrack != nil {
+		s.untrack()
+	}
+	s.stats.Close()
 }
 
 func (c *serverSession) recvLoop(cancel context.CancelCauseFunc) error {
 	for {
 		err := c.recv()
 		if err != nil {
+			if c.ctx.Err() != nil {
+				err = context.Cause(c.ctx)
+			}
 			cancel(err)
 			return E.Cause(err, "mux connection closed")
 		}
 	}
 }
 
+func (c *serverSession) updateActivity() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *serverSession) lastActivityTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+// keepAliveLoop sends keepalive frames and closes the session if the client is silent for too long.
+func (c *serverSession) keepAliveLoop(cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(c.options.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var err error
+		if c.options.KeepAliveMaxMissed > 0 && time.Since(c.lastActivityTime()) >= time.Duration(c.options.KeepAliveMaxMissed)*c.options.KeepAliveInterval {
+			err = ErrMuxSessionTimeout
+		} else {
+			err = c.syncKeepAlive()
+		}
+		if err != nil {
+			cancel(err)
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
 func (c *serverSession) cleanup(err error) {
 	c.streamAccess.Lock()
 	for _, stream := range c.streams {
-		_ = stream.pipe.CloseWithError(err)
+		stream.closeWithError(err)
 	}
 	c.streamAccess.Unlock()
 }
@@ -80,6 +209,10 @@ func (c *serverSession) recv() error {
 	if err != nil {
 		return E.Cause(err, "read frame header")
 	}
+	c.updateActivity()
+	if length < 4 {
+		return c.badFrame(E.New("bad frame metadata length: ", length))
+	}
 
 	var sessionID uint16
 	err = binary.Read(c.conn, binary.BigEndian, &sessionID)
@@ -102,56 +235,113 @@ func (c *serverSession) recv() error {
 	var network byte
 	var destination M.Socksaddr
 	if length > 4 {
-		limitReader := io.LimitReader(c.conn, int64(length-4))
-		err = binary.Read(limitReader, binary.BigEndian, &network)
+		// The metadata is read before it is parsed, so parse errors are told apart from transport errors.
+		metadata := buf.NewSize(int(length - 4))
+		_, err = metadata.ReadFullFrom(c.conn, int(length-4))
 		if err != nil {
+			metadata.Release()
 			return err
 		}
-		destination, err = AddressSerializer.ReadAddrPort(limitReader)
-		if err != nil {
-			return err
+		network, err = metadata.ReadByte()
+		if err == nil {
+			destination, err = AddressSerializer.ReadAddrPort(metadata)
 		}
-		if limitReader.(*io.LimitedReader).N > 0 {
-			_, err = io.Copy(io.Discard, limitReader)
-			if err != nil {
-				return err
-			}
+		metadata.Release()
+		if err != nil {
+			return c.badFrame(E.Cause(err, "read frame metadata"))
 		}
 	}
 
 	var stream *serverStream
 	switch status {
 	case StatusNew:
-		pipeIn, pipeOut := io.Pipe()
+		switch network {
+		case NetworkTCP, NetworkUDP:
+		default:
+			return c.badFrame(E.New("bad network: ", network))
+		}
+		c.streamAccess.RLock()
+		_, loaded := c.streams[sessionID]
+		c.streamAccess.RUnlock()
+		if loaded {
+			// The client can no longer tell the two streams apart, so both are closed.
+			err = E.New("duplicate session: ", sessionID)
+			c.localClose(nil, sessionID, err)
+			c.rejectStream(sessionID, RejectReasonBadFrame, err)
+			break
+		}
+		err = c.admitStream()
+		if err != nil {
+			c.rejectStream(sessionID, RejectReasonLimit, err)
+			break
+		}
+		streamCtx := c.ctx
+		if c.options.RouteStream != nil {
+			streamCtx, destination, err = c.options.RouteStream(c.ctx, muxCommand(network), destination)
+			if err != nil {
+				c.rejectStream(sessionID, RejectReasonHook, err)
+				break
+			}
+		}
 		stream = &serverStream{
-			network,
-			destination,
-			pipeOut,
+			network:     network,
+			destination: destination,
+			buffer:      newMuxBuffer(c.options.StreamBufferSize),
+		}
+		if c.options.TrackStream != nil {
+			stream.untrack, err = c.options.TrackStream(func(err error) {
+				_ = c.close(stream, sessionID, err)
+			})
+			if err != nil {
+				stream.buffer.closeWithError(err)
+				stream = nil
+				c.rejectStream(sessionID, RejectReasonLimit, err)
+				break
+			}
+		}
+		if c.options.StreamStats != nil {
+			stream.stats = c.options.StreamStats(muxCommand(network), destination)
+		}
+		idleTimeout := c.options.IdleTimeout
+		if c.options.StreamIdleTimeout > 0 {
+			idleTimeout = c.options.StreamIdleTimeout
+		}
+		if idleTimeout > 0 {
+			stream.idleTimer = newActivityTimer(idleTimeout, func() {
+				_ = c.close(stream, sessionID, ErrIdleTimeout)
+			})
 		}
 		c.streamAccess.Lock()
 		c.streams[sessionID] = stream
 		c.streamAccess.Unlock()
-		switch network {
-		case NetworkTCP, NetworkUDP:
-		default:
-			return E.New("bad network: ", network)
-		}
 		go func() {
 			if network == NetworkTCP {
 				conn := &serverMuxConn{
 					sessionID,
-					pipeIn,
+					stream.buffer,
 					c,
+					stream.idleTimer,
+					stream,
 				}
-				c.handler.NewConnectionEx(c.ctx, conn, c.source, destination, nil)
+				var streamConn net.Conn = stream.stats.WrapConn(conn)
+				if c.options.WrapConn != nil {
+					streamConn = c.options.WrapConn(streamConn)
+				}
+				c.handler.NewConnectionEx(streamCtx, streamConn, c.source, destination, nil)
 			} else {
 				conn := &serverMuxPacketConn{
 					sessionID,
-					pipeIn,
+					stream.buffer,
 					c,
 					destination,
+					stream.idleTimer,
+					stream,
+				}
+				var streamConn N.PacketConn = stream.stats.WrapPacketConn(conn)
+				if c.options.WrapPacketConn != nil {
+					streamConn = c.options.WrapPacketConn(streamConn)
 				}
-				c.handler.NewPacketConnectionEx(c.ctx, conn, c.source, destination, nil)
+				c.handler.NewPacketConnectionEx(streamCtx, streamConn, c.source, destination, nil)
 			}
 		}()
 	case StatusKeep:
@@ -164,12 +354,13 @@ func (c *serverSession) recv() error {
 		}
 	case StatusEnd:
 		if option&OptionError == OptionError {
-			err = E.New("remote closed wth error")
+			c.localClose(nil, sessionID, E.New("remote closed with error"))
+		} else {
+			c.remoteCloseWrite(sessionID)
 		}
-		c.localClose(sessionID, err)
 	case StatusKeepAlive:
 	default:
-		return E.New("bad session status: ", status)
+		return c.badFrame(E.New("bad session status: ", status))
 	}
 
 	if option&OptionData != OptionData {
@@ -190,10 +381,9 @@ func (c *serverSession) recv() error {
 	}
 
 	data := buf.NewSize(int(length))
-	defer data.Release()
-
 	_, err = data.ReadFullFrom(c.conn, int(length))
 	if err != nil {
+		data.Release()
 		return err
 	}
 
@@ -201,32 +391,59 @@ func (c *serverSession) recv() error {
 		destination = stream.destination
 	}
 
+	stream.idleTimer.update()
 	err = c.recvTo(stream, data, destination)
 	if err != nil {
-		return c.close(sessionID, err)
+		return c.close(stream, sessionID, err)
 	}
 
 	return nil
 }
 
-func (c *serverSession) recvTo(stream *serverStream, data *buf.Buffer, destination M.Socksaddr) error {
-	if stream.network == NetworkTCP {
-		return common.Error(stream.pipe.Write(data.Bytes()))
-	} else {
-		err := binary.Write(stream.pipe, binary.BigEndian, uint16(data.Len()))
-		if err != nil {
-			return err
+func (c *serverSession) badFrame(cause error) error {
+	return NewRejectError("mux", RejectStageBody, RejectReasonBadFrame, nil, c.source, cause)
+}
+
+// admitStream checks the stream limits of the session policy before a new stream is created,
+// it is only called by the receive loop.
+func (c *serverSession) admitStream() error {
+	if c.options.MaxStreams > 0 {
+		c.streamAccess.RLock()
+		streams := len(c.streams)
+		c.streamAccess.RUnlock()
+		if streams >= c.options.MaxStreams {
+			return ErrMuxStreamLimit
 		}
-		_, err = stream.pipe.Write(data.Bytes())
-		if err != nil {
-			return err
+	}
+	if c.options.MaxNewStreamsPerSecond > 0 {
+		now := time.Now()
+		if now.Sub(c.rateStart) >= time.Second {
+			c.rateStart = now
+			c.rateCount = 0
 		}
-		err = AddressSerializer.WriteAddrPort(stream.pipe, destination)
-		if err != nil {
-			return err
+		if c.rateCount >= c.options.MaxNewStreamsPerSecond {
+			return ErrMuxStreamRate
 		}
+		c.rateCount++
+	}
+	return nil
+}
+
+// rejectStream closes a new stream with OptionError and reports cause to RejectStream.
+func (c *serverSession) rejectStream(sessionID uint16, reason RejectReason, cause error) {
+	go c.syncClose(sessionID, true)
+	if c.options.RejectStream != nil {
+		c.options.RejectStream(NewRejectError("mux", RejectStageBody, reason, nil, c.source, cause))
+	}
+}
+
+// recvTo queues data for stream, packets of UDP streams are dropped if its buffer is full.
+func (c *serverSession) recvTo(stream *serverStream, data *buf.Buffer, destination M.Socksaddr) error {
+	err := stream.buffer.push(data, destination)
+	if err == ErrMuxBufferFull && stream.network == NetworkUDP {
 		return nil
 	}
+	return err
 }
 
 func (c *serverSession) syncWrite(sessionID uint16, data []byte) (int, error) {
@@ -321,23 +538,64 @@ func (c *serverSession) writePacketFrame(sessionID uint16, data []byte, destinat
 	return common.Error(c.writer.Write(data))
 }
 
-func (c *serverSession) close(sessionID uint16, err error) error {
-	if c.localClose(sessionID, err) {
+func (c *serverSession) close(stream *serverStream, sessionID uint16, err error) error {
+	if c.localClose(stream, sessionID, err) {
 		return c.syncClose(sessionID, err != nil)
 	}
 	return nil
 }
 
-func (c *serverSession) localClose(sessionID uint16, err error) bool {
-	var closed bool
+// localClose removes stream, or any stream with sessionID if nil, so closing a stream does not remove
+// a later stream reusing its ID. It reports whether the client has to be notified with StatusEnd.
+func (c *serverSession) localClose(stream *serverStream, sessionID uint16, err error) bool {
+	var notify bool
 	c.streamAccess.Lock()
-	if session, loaded := c.streams[sessionID]; loaded {
+	if current, loaded := c.streams[sessionID]; loaded && (stream == nil || current == stream) {
+		stream = current
 		delete(c.streams, sessionID)
-		_ = session.pipe.CloseWithError(err)
-		closed = true
+		stream.closeWithError(err)
+		notify = err != nil || !stream.writeClosed.Load()
 	}
 	c.streamAccess.Unlock()
-	return closed
+	return notify
+}
+
+// remoteCloseWrite handles StatusEnd without error. Reads of TCP streams return io.EOF once the buffer is drained,
+// and the handler can keep writing until it closes the stream. Other streams are closed.
+func (c *serverSession) remoteCloseWrite(sessionID uint16) {
+	c.streamAccess.Lock()
+	stream, loaded := c.streams[sessionID]
+	if !loaded {
+		c.streamAccess.Unlock()
+		return
+	}
+	stream.readClosed = true
+	if stream.network == NetworkTCP && !stream.writeClosed.Load() {
+		c.streamAccess.Unlock()
+		stream.buffer.closeWithError(nil)
+		return
+	}
+	delete(c.streams, sessionID)
+	c.streamAccess.Unlock()
+	stream.closeWithError(nil)
+}
+
+// closeWrite sends StatusEnd for a TCP stream, the stream is removed if the client has closed it too.
+func (c *serverSession) closeWrite(stream *serverStream, sessionID uint16) error {
+	c.streamAccess.Lock()
+	if c.streams[sessionID] != stream || stream.writeClosed.Swap(true) {
+		c.streamAccess.Unlock()
+		return nil
+	}
+	closed := stream.readClosed
+	if closed {
+		delete(c.streams, sessionID)
+	}
+	c.streamAccess.Unlock()
+	if closed {
+		stream.closeWithError(nil)
+	}
+	return c.syncClose(sessionID, false)
 }
 
 func (c *serverSession) syncClose(sessionID uint16, hasError bool) error {
@@ -357,6 +615,35 @@ func (c *serverSession) syncClose(sessionID uint16, hasError bool) error {
 	return nil
 }
 
+func (c *serverSession) syncKeepAlive() error {
+	writeRace := atomic.AddUint32(&c.writeRace, 1)
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	_, err := c.writer.Write([]byte{0, 4, 0, 0, StatusKeepAlive, 0})
+	if err != nil {
+		return err
+	}
+	if writeRace == atomic.LoadUint32(&c.writeRace) {
+		return c.writer.Flush()
+	}
+	return nil
+}
+
+// writeBuffer writes a frame built in the headroom of buffer directly to the connection, after the frames
+// buffered by the other writes, so that frames of concurrent streams and keepalives do not interleave.
+func (c *serverSession) writeBuffer(buffer *buf.Buffer) error {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if c.writer.Buffered() > 0 {
+		err := c.writer.Flush()
+		if err != nil {
+			buffer.Release()
+			return err
+		}
+	}
+	return c.directWriter.WriteBuffer(buffer)
+}
+
 func (c *serverSession) writeCloseFrame(sessionID uint16, hasError bool) error {
 	err := binary.Write(c.writer, binary.BigEndian, uint16(4))
 	if err != nil {
@@ -378,22 +665,49 @@ func (c *serverSession) writeCloseFrame(sessionID uint16, hasError bool) error {
 	return err
 }
 
+var _ N.WriteCloser = (*serverMuxConn)(nil)
+
 type serverMuxConn struct {
 	sessionID uint16
-	pipe      *io.PipeReader
+	buffer    *muxBuffer
 	session   *serverSession
+	idleTimer *activityTimer
+	stream    *serverStream
 }
 
 func (c *serverMuxConn) Read(b []byte) (n int, err error) {
-	return c.pipe.Read(b)
+	return c.buffer.Read(b)
 }
 
 func (c *serverMuxConn) Write(b []byte) (n int, err error) {
-	return c.session.syncWrite(c.sessionID, b)
+	if c.stream.writeClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	c.idleTimer.update()
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > muxFrameSize {
+			chunk = chunk[:muxFrameSize]
+		}
+		_, err = c.session.syncWrite(c.sessionID, chunk)
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+	}
+	return
 }
 
 func (c *serverMuxConn) WriteBuffer(buffer *buf.Buffer) error {
+	if c.stream.writeClosed.Load() {
+		return io.ErrClosedPipe
+	}
 	dataLen := buffer.Len()
+	if dataLen > math.MaxUint16 {
+		defer buffer.Release()
+		return common.Error(c.Write(buffer.Bytes()))
+	}
+	c.idleTimer.update()
 	header := buf.With(buffer.ExtendHeader(8))
 	common.Must(
 		binary.Write(header, binary.BigEndian, uint16(4)),
@@ -402,7 +716,11 @@ func (c *serverMuxConn) WriteBuffer(buffer *buf.Buffer) error {
 		binary.Write(header, binary.BigEndian, uint8(OptionData)),
 		binary.Write(header, binary.BigEndian, uint16(dataLen)),
 	)
-	return c.session.directWriter.WriteBuffer(buffer)
+	return c.session.writeBuffer(buffer)
+}
+
+func (c *serverMuxConn) SessionLastActivity() time.Time {
+	return c.session.lastActivityTime()
 }
 
 func (c *serverMuxConn) FrontHeadroom() int {
@@ -414,7 +732,12 @@ func (c *serverMuxConn) UpstreamWriter() any {
 }
 
 func (c *serverMuxConn) Close() error {
-	return c.session.close(c.sessionID, nil)
+	return c.session.close(c.stream, c.sessionID, nil)
+}
+
+// CloseWrite sends StatusEnd while the stream can still be read.
+func (c *serverMuxConn) CloseWrite() error {
+	return c.session.closeWrite(c.stream, c.sessionID)
 }
 
 func (c *serverMuxConn) LocalAddr() net.Addr {
@@ -445,9 +768,11 @@ var _ PacketConn = (*serverMuxPacketConn)(nil)
 
 type serverMuxPacketConn struct {
 	sessionID   uint16
-	pipe        *io.PipeReader
+	buffer      *muxBuffer
 	session     *serverSession
 	destination M.Socksaddr
+	idleTimer   *activityTimer
+	stream      *serverStream
 }
 
 func (c *serverMuxPacketConn) Read(b []byte) (n int, err error) {
@@ -464,45 +789,39 @@ func (c *serverMuxPacketConn) RemoteAddr() net.Addr {
 }
 
 func (c *serverMuxPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	var length uint16
-	err = binary.Read(c.pipe, binary.BigEndian, &length)
+	packet, err := c.buffer.readPacket()
 	if err != nil {
 		return
 	}
-	if int(length) > len(p) {
-		return 0, nil, E.Extend(io.ErrShortBuffer, "mux need ", length)
-	}
-	n, err = io.ReadFull(c.pipe, p[:length])
-	if err == nil {
-		addr, err = AddressSerializer.ReadAddrPort(c.pipe)
+	defer packet.buffer.Release()
+	if packet.buffer.Len() > len(p) {
+		return 0, nil, E.Extend(io.ErrShortBuffer, "mux need ", packet.buffer.Len())
 	}
+	n = copy(p, packet.buffer.Bytes())
+	addr = packet.destination
 	return
 }
 
 func (c *serverMuxPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
-	var length uint16
-	err = binary.Read(c.pipe, binary.BigEndian, &length)
+	packet, err := c.buffer.readPacket()
 	if err != nil {
 		return
 	}
-	if int(length) > buffer.FreeLen() {
-		return M.Socksaddr{}, E.Extend(io.ErrShortBuffer, "mux need ", length)
-	}
-	_, err = buffer.ReadFullFrom(c.pipe, int(length))
-	if err == nil {
-		destination, err = AddressSerializer.ReadAddrPort(c.pipe)
-		if err == nil {
-			destination = destination.Unwrap()
-		}
+	defer packet.buffer.Release()
+	if packet.buffer.Len() > buffer.FreeLen() {
+		return M.Socksaddr{}, E.Extend(io.ErrShortBuffer, "mux need ", packet.buffer.Len())
 	}
-	return
+	common.Must1(buffer.Write(packet.buffer.Bytes()))
+	return packet.destination.Unwrap(), nil
 }
 
 func (c *serverMuxPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.idleTimer.update()
 	return c.session.syncWritePacket(c.sessionID, p, M.SocksaddrFromNet(addr))
 }
 
 func (c *serverMuxPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	c.idleTimer.update()
 	dataLen := buffer.Len()
 	header := buf.With(buffer.ExtendHeader(9 + AddressSerializer.AddrPortLen(destination)))
 	common.Must(
@@ -517,7 +836,11 @@ func (c *serverMuxPacketConn) WritePacket(buffer *buf.Buffer, destination M.Sock
 		return err
 	}
 	common.Must(binary.Write(header, binary.BigEndian, uint16(dataLen)))
-	return c.session.directWriter.WriteBuffer(buffer)
+	return c.session.writeBuffer(buffer)
+}
+
+func (c *serverMuxPacketConn) SessionLastActivity() time.Time {
+	return c.session.lastActivityTime()
 }
 
 func (c *serverMuxPacketConn) FrontHeadroom() int {
@@ -529,7 +852,7 @@ func (c *serverMuxPacketConn) UpstreamWriter() any {
 }
 
 func (c *serverMuxPacketConn) Close() error {
-	return c.session.close(c.sessionID, nil)
+	return c.session.close(c.stream, c.sessionID, nil)
 }
 
 func (c *serverMuxPacketConn) LocalAddr() net.Addr {
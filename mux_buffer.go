@@ -0,0 +1,117 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var ErrMuxBufferFull = E.New("mux stream buffer full")
+
+const DefaultMuxStreamBufferSize = 512 * 1024
+
+type muxPacket struct {
+	buffer      *buf.Buffer
+	destination M.Socksaddr
+}
+
+// muxBuffer is the bounded receive buffer of a mux stream. Frames are queued without blocking
+// the receive loop of the session, so a slow stream does not stall the other streams.
+type muxBuffer struct {
+	access  sync.Mutex
+	cond    *sync.Cond
+	packets []muxPacket
+	size    int
+	limit   int
+	err     error
+}
+
+func newMuxBuffer(limit int) *muxBuffer {
+	if limit <= 0 {
+		limit = DefaultMuxStreamBufferSize
+	}
+	b := &muxBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.access)
+	return b
+}
+
+// push queues data, it returns ErrMuxBufferFull if the limit is exceeded.
+// data is released if it is not queued.
+func (b *muxBuffer) push(data *buf.Buffer, destination M.Socksaddr) error {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.err != nil {
+		data.Release()
+		return io.ErrClosedPipe
+	}
+	if b.size+data.Len() > b.limit {
+		data.Release()
+		return ErrMuxBufferFull
+	}
+	b.packets = append(b.packets, muxPacket{data, destination})
+	b.size += data.Len()
+	b.cond.Signal()
+	return nil
+}
+
+func (b *muxBuffer) Read(p []byte) (n int, err error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	for len(b.packets) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.cond.Wait()
+	}
+	head := b.packets[0].buffer
+	n = copy(p, head.Bytes())
+	head.Advance(n)
+	b.size -= n
+	if head.IsEmpty() {
+		head.Release()
+		b.packets[0] = muxPacket{}
+		b.packets = b.packets[1:]
+	}
+	return
+}
+
+// readPacket returns the next queued frame, the caller owns its buffer.
+func (b *muxBuffer) readPacket() (muxPacket, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	for len(b.packets) == 0 {
+		if b.err != nil {
+			return muxPacket{}, b.err
+		}
+		b.cond.Wait()
+	}
+	packet := b.packets[0]
+	b.packets[0] = muxPacket{}
+	b.packets = b.packets[1:]
+	b.size -= packet.buffer.Len()
+	return packet, nil
+}
+
+// closeWithError makes reads fail with err, or io.EOF if err is nil once the queued data is read.
+// Queued data is dropped if err is not nil.
+func (b *muxBuffer) closeWithError(err error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.err != nil {
+		return
+	}
+	if err == nil {
+		b.err = io.EOF
+	} else {
+		b.err = err
+		for _, packet := range b.packets {
+			packet.buffer.Release()
+		}
+		b.packets = nil
+		b.size = 0
+	}
+	b.cond.Broadcast()
+}
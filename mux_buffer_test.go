@@ -0,0 +1,188 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestMuxBufferLimit(t *testing.T) {
+	t.Parallel()
+	buffer := newMuxBuffer(8)
+	err := buffer.push(buf.As([]byte("12345")), M.Socksaddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = buffer.push(buf.As([]byte("6789")), M.Socksaddr{})
+	if err != ErrMuxBufferFull {
+		t.Fatal("expected full buffer, got ", err)
+	}
+	response := make([]byte, 3)
+	_, err = io.ReadFull(buffer, response)
+	if err != nil || string(response) != "123" {
+		t.Fatal("bad read ", string(response), err)
+	}
+	err = buffer.push(buf.As([]byte("6789")), M.Socksaddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = make([]byte, 6)
+	_, err = io.ReadFull(buffer, response)
+	if err != nil || string(response) != "456789" {
+		t.Fatal("bad read ", string(response), err)
+	}
+}
+
+func TestMuxBufferClose(t *testing.T) {
+	t.Parallel()
+	buffer := newMuxBuffer(0)
+	err := buffer.push(buf.As([]byte("data")), M.Socksaddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.closeWithError(nil)
+	if buffer.push(buf.As([]byte("late")), M.Socksaddr{}) != io.ErrClosedPipe {
+		t.Fatal("push after close")
+	}
+	response, err := io.ReadAll(buffer)
+	if err != nil || string(response) != "data" {
+		t.Fatal("queued data not read before EOF ", string(response), err)
+	}
+
+	closeErr := errors.New("reset")
+	buffer = newMuxBuffer(0)
+	err = buffer.push(buf.As([]byte("data")), M.Socksaddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.closeWithError(closeErr)
+	_, err = buffer.readPacket()
+	if err != closeErr {
+		t.Fatal("queued data not dropped on error ", err)
+	}
+}
+
+// testStallHandler echoes its streams, but does not read the streams of network until release is closed.
+type testStallHandler struct {
+	network string
+	release chan struct{}
+}
+
+func (h testStallHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		if h.network == N.NetworkTCP {
+			<-h.release
+		}
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+}
+
+func (h testStallHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		if h.network == N.NetworkUDP {
+			<-h.release
+		}
+		_, _ = bufio.CopyPacket(conn, conn)
+		_ = conn.Close()
+	}()
+}
+
+func testMuxEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || string(response) != "ping" {
+		t.Fatal("echo failed: ", err)
+	}
+}
+
+func TestMuxBufferOverflowTCP(t *testing.T) {
+	t.Parallel()
+	handler := testStallHandler{N.NetworkTCP, make(chan struct{})}
+	address := startTestMuxServer(t, handler, ServiceWithMuxPolicy(MuxPolicy{StreamBufferSize: 1024}))
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || err == io.EOF {
+		t.Fatal("expected the overflowed stream to be closed with an error, got ", err)
+	}
+	close(handler.release)
+	conn, err = client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	if client.Connections() != 1 {
+		t.Fatal("unexpected connections: ", client.Connections())
+	}
+}
+
+func TestMuxBufferOverflowUDP(t *testing.T) {
+	t.Parallel()
+	handler := testStallHandler{N.NetworkUDP, make(chan struct{})}
+	address := startTestMuxServer(t, handler, ServiceWithMuxPolicy(MuxPolicy{StreamBufferSize: 1024}))
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packetConn, err := client.DialPacketConn(context.Background(), M.ParseSocksaddr("1.1.1.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	packet := bytes.Repeat([]byte{'x'}, 100)
+	const sent = 50
+	for i := 0; i < sent; i++ {
+		_, err = packetConn.Write(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The marker fits in the buffer after the queued packets, it is only received if the stream survived.
+	_, err = packetConn.Write([]byte("end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Frames are received in order, so the server has queued or dropped every packet once the echo returns.
+	testMuxEcho(t, conn)
+	close(handler.release)
+	var received int
+	response := make([]byte, 256)
+	for {
+		n, err := packetConn.Read(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response[:n]) == "end" {
+			break
+		}
+		received++
+	}
+	if received != 1024/len(packet) {
+		t.Fatal("expected packets over the buffer size to be dropped, received ", received, " of ", sent)
+	}
+}
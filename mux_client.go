@@ -0,0 +1,656 @@
+package vmess
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	DefaultMuxConcurrency = 8
+	DefaultMuxIdleTimeout = 16 * time.Second
+)
+
+// MuxDialer opens a new Mux.Cool connection for a MuxClient,
+// such as a connection returned by Client.DialMuxConn or vless.Client.DialMuxConn.
+type MuxDialer func(ctx context.Context) (net.Conn, error)
+
+type MuxClientOptions struct {
+	// MaxConcurrency is the maximum number of concurrent streams on one connection,
+	// a new connection is opened once all connections are full. The default is DefaultMuxConcurrency.
+	MaxConcurrency int
+	// StreamBufferSize is the number of bytes received for each stream until it is read,
+	// see MuxServerOptions.StreamBufferSize.
+	StreamBufferSize int
+	// KeepAliveInterval is the interval the client sends keepalive frames at,
+	// to keep sessions open on servers that close silent sessions.
+	KeepAliveInterval time.Duration
+	// IdleTimeout closes connections that have no streams for this duration, the default is DefaultMuxIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// MuxClient multiplexes TCP and UDP streams over Mux.Cool connections.
+type MuxClient struct {
+	dialer         MuxDialer
+	maxConcurrency int
+	bufferSize     int
+	keepAlive      time.Duration
+	idleTimeout    time.Duration
+	access         sync.Mutex
+	sessions       []*clientSession
+	dialing        *muxDial
+	closed         bool
+}
+
+// muxDial is a connection being dialed, callers that find all connections full wait for it
+// instead of dialing one each.
+type muxDial struct {
+	done chan struct{}
+	err  error
+}
+
+func NewMuxClient(dialer MuxDialer, options MuxClientOptions) *MuxClient {
+	if options.MaxConcurrency <= 0 {
+		options.MaxConcurrency = DefaultMuxConcurrency
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = DefaultMuxIdleTimeout
+	}
+	return &MuxClient{
+		dialer:         dialer,
+		maxConcurrency: options.MaxConcurrency,
+		bufferSize:     options.StreamBufferSize,
+		keepAlive:      options.KeepAliveInterval,
+		idleTimeout:    options.IdleTimeout,
+	}
+}
+
+func (c *MuxClient) DialConn(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	stream, err := c.openStream(ctx, NetworkTCP, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &clientMuxConn{stream}, nil
+}
+
+func (c *MuxClient) DialPacketConn(ctx context.Context, destination M.Socksaddr) (PacketConn, error) {
+	stream, err := c.openStream(ctx, NetworkUDP, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &clientMuxPacketConn{stream}, nil
+}
+
+// Connections returns the number of open connections.
+func (c *MuxClient) Connections() int {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return len(c.sessions)
+}
+
+// Close closes all connections and streams, the client can not be used after.
+func (c *MuxClient) Close() error {
+	c.access.Lock()
+	c.closed = true
+	sessions := c.sessions
+	c.sessions = nil
+	c.access.Unlock()
+	for _, session := range sessions {
+		session.close(net.ErrClosed)
+	}
+	return nil
+}
+
+func (c *MuxClient) openStream(ctx context.Context, network byte, destination M.Socksaddr) (*clientStream, error) {
+	stream, err := c.reserveStream(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.session.writeFrame(stream.sessionID, StatusNew, 0, network, destination, nil)
+	if err != nil {
+		stream.session.closeStream(stream, err, false)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (c *MuxClient) reserveStream(ctx context.Context, network byte, destination M.Socksaddr) (*clientStream, error) {
+	for {
+		c.access.Lock()
+		if c.closed {
+			c.access.Unlock()
+			return nil, net.ErrClosed
+		}
+		for _, session := range c.sessions {
+			stream := session.newStream(network, destination)
+			if stream != nil {
+				c.access.Unlock()
+				return stream, nil
+			}
+		}
+		dial := c.dialing
+		if dial != nil {
+			c.access.Unlock()
+			select {
+			case <-dial.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if dial.err != nil {
+				return nil, dial.err
+			}
+			continue
+		}
+		dial = &muxDial{done: make(chan struct{})}
+		c.dialing = dial
+		c.access.Unlock()
+		return c.dialStream(ctx, dial, network, destination)
+	}
+}
+
+// dialStream dials a new connection for dial and reserves the first stream on it,
+// the streams of the callers waiting for dial are reserved after.
+func (c *MuxClient) dialStream(ctx context.Context, dial *muxDial, network byte, destination M.Socksaddr) (*clientStream, error) {
+	conn, err := c.dialer(ctx)
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.dialing = nil
+	defer close(dial.done)
+	if err != nil {
+		dial.err = E.Cause(err, "dial mux connection")
+		return nil, dial.err
+	}
+	if c.closed {
+		_ = conn.Close()
+		dial.err = net.ErrClosed
+		return nil, dial.err
+	}
+	session := &clientSession{
+		client:  c,
+		conn:    conn,
+		streams: make(map[uint16]*clientStream),
+		done:    make(chan struct{}),
+	}
+	c.sessions = append(c.sessions, session)
+	stream := session.newStream(network, destination)
+	go session.recvLoop()
+	if c.keepAlive > 0 {
+		go session.keepAliveLoop()
+	}
+	return stream, nil
+}
+
+func (c *MuxClient) removeSession(session *clientSession) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	for i, element := range c.sessions {
+		if element == session {
+			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+type clientSession struct {
+	client       *MuxClient
+	conn         net.Conn
+	writeAccess  sync.Mutex
+	streamAccess sync.Mutex
+	streams      map[uint16]*clientStream
+	lastID       uint16
+	idleTimer    *time.Timer
+	idleSequence uint64
+	closed       bool
+	done         chan struct{}
+}
+
+type clientStream struct {
+	session     *clientSession
+	sessionID   uint16
+	network     byte
+	destination M.Socksaddr
+	buffer      *muxBuffer
+	// done is set once the stream can not be written, readClosed and writeClosed are
+	// set once the server or the client has closed its direction of a TCP stream.
+	done        atomic.Bool
+	readClosed  bool
+	writeClosed bool
+}
+
+// newStream registers a stream, it returns nil if the session is closed, full or out of session IDs.
+func (s *clientSession) newStream(network byte, destination M.Socksaddr) *clientStream {
+	s.streamAccess.Lock()
+	defer s.streamAccess.Unlock()
+	if s.closed || len(s.streams) >= s.client.maxConcurrency || s.lastID == math.MaxUint16 {
+		return nil
+	}
+	s.stopIdleTimer()
+	s.lastID++
+	stream := &clientStream{
+		session:     s,
+		sessionID:   s.lastID,
+		network:     network,
+		destination: destination,
+		buffer:      newMuxBuffer(s.client.bufferSize),
+	}
+	s.streams[stream.sessionID] = stream
+	return stream
+}
+
+// closeStream removes stream, and tells the server to close it if notify is set.
+func (s *clientSession) closeStream(stream *clientStream, err error, notify bool) {
+	s.streamAccess.Lock()
+	if s.streams[stream.sessionID] != stream {
+		s.streamAccess.Unlock()
+		return
+	}
+	delete(s.streams, stream.sessionID)
+	exhausted := s.lastID == math.MaxUint16 && len(s.streams) == 0
+	if len(s.streams) == 0 && !exhausted && !s.closed {
+		s.startIdleTimer()
+	}
+	notify = notify && (err != nil || !stream.writeClosed)
+	s.streamAccess.Unlock()
+	stream.closeWithError(err)
+	if notify {
+		var option byte
+		if err != nil {
+			option = OptionError
+		}
+		_ = s.writeFrame(stream.sessionID, StatusEnd, option, 0, M.Socksaddr{}, nil)
+	}
+	if exhausted {
+		s.close(net.ErrClosed)
+	}
+}
+
+// remoteCloseWrite handles StatusEnd without error, see serverSession.remoteCloseWrite.
+func (s *clientSession) remoteCloseWrite(stream *clientStream) {
+	s.streamAccess.Lock()
+	if s.streams[stream.sessionID] != stream {
+		s.streamAccess.Unlock()
+		return
+	}
+	stream.readClosed = true
+	closed := stream.network != NetworkTCP || stream.writeClosed
+	s.streamAccess.Unlock()
+	if closed {
+		s.closeStream(stream, nil, false)
+	} else {
+		stream.buffer.closeWithError(nil)
+	}
+}
+
+// closeWrite sends StatusEnd for a TCP stream, the stream is removed if the server has closed it too.
+func (s *clientSession) closeWrite(stream *clientStream) error {
+	s.streamAccess.Lock()
+	if s.streams[stream.sessionID] != stream || stream.writeClosed {
+		s.streamAccess.Unlock()
+		return nil
+	}
+	stream.writeClosed = true
+	stream.done.Store(true)
+	closed := stream.readClosed
+	s.streamAccess.Unlock()
+	err := s.writeFrame(stream.sessionID, StatusEnd, 0, 0, M.Socksaddr{}, nil)
+	if closed {
+		s.closeStream(stream, nil, false)
+	}
+	return err
+}
+
+// startIdleTimer closes the session once it has no streams for the idle timeout, like the v2ray client.
+// It is called with streamAccess held.
+func (s *clientSession) startIdleTimer() {
+	s.stopIdleTimer()
+	sequence := s.idleSequence
+	s.idleTimer = time.AfterFunc(s.client.idleTimeout, func() {
+		s.closeIdle(sequence)
+	})
+}
+
+func (s *clientSession) stopIdleTimer() {
+	s.idleSequence++
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+func (s *clientSession) closeIdle(sequence uint64) {
+	s.streamAccess.Lock()
+	idle := s.idleSequence == sequence && len(s.streams) == 0
+	s.streamAccess.Unlock()
+	if !idle {
+		return
+	}
+	// No stream can be opened once the session is removed from the client, except for one
+	// that was reserved just before, the session is then closed after that stream.
+	s.client.removeSession(s)
+	s.streamAccess.Lock()
+	idle = len(s.streams) == 0
+	s.streamAccess.Unlock()
+	if idle {
+		s.close(net.ErrClosed)
+	}
+}
+
+func (s *clientSession) close(err error) {
+	s.streamAccess.Lock()
+	if s.closed {
+		s.streamAccess.Unlock()
+		return
+	}
+	s.closed = true
+	s.stopIdleTimer()
+	close(s.done)
+	streams := s.streams
+	s.streams = make(map[uint16]*clientStream)
+	s.streamAccess.Unlock()
+	for _, stream := range streams {
+		stream.closeWithError(err)
+	}
+	_ = s.conn.Close()
+	s.client.removeSession(s)
+}
+
+func (s *clientSession) recvLoop() {
+	for {
+		err := s.recv()
+		if err != nil {
+			s.close(E.Cause(err, "mux connection closed"))
+			return
+		}
+	}
+}
+
+func (s *clientSession) keepAliveLoop() {
+	ticker := time.NewTicker(s.client.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := s.writeFrame(0, StatusKeepAlive, 0, 0, M.Socksaddr{}, nil)
+		if err != nil {
+			s.close(E.Cause(err, "write keepalive"))
+			return
+		}
+	}
+}
+
+func (s *clientSession) recv() error {
+	var length uint16
+	err := binary.Read(s.conn, binary.BigEndian, &length)
+	if err != nil {
+		return E.Cause(err, "read frame header")
+	}
+	if length < 4 {
+		return E.New("bad frame length: ", length)
+	}
+	var header [4]byte
+	_, err = io.ReadFull(s.conn, header[:])
+	if err != nil {
+		return err
+	}
+	sessionID := binary.BigEndian.Uint16(header[:])
+	status := header[2]
+	option := header[3]
+
+	var destination M.Socksaddr
+	if length > 4 {
+		limitReader := io.LimitReader(s.conn, int64(length-4))
+		var network byte
+		err = binary.Read(limitReader, binary.BigEndian, &network)
+		if err != nil {
+			return err
+		}
+		destination, err = AddressSerializer.ReadAddrPort(limitReader)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, limitReader)
+		if err != nil {
+			return err
+		}
+	}
+
+	var stream *clientStream
+	switch status {
+	case StatusKeep:
+		s.streamAccess.Lock()
+		stream = s.streams[sessionID]
+		s.streamAccess.Unlock()
+		if stream == nil {
+			go s.writeFrame(sessionID, StatusEnd, OptionError, 0, M.Socksaddr{}, nil)
+		}
+	case StatusEnd:
+		s.streamAccess.Lock()
+		stream = s.streams[sessionID]
+		s.streamAccess.Unlock()
+		if stream != nil {
+			if option&OptionError == OptionError {
+				s.closeStream(stream, E.New("remote closed with error"), false)
+			} else {
+				s.remoteCloseWrite(stream)
+			}
+			stream = nil
+		}
+	case StatusKeepAlive:
+	case StatusNew:
+		return E.New("unexpected frame new")
+	default:
+		return E.New("bad session status: ", status)
+	}
+
+	if option&OptionData != OptionData {
+		return nil
+	}
+	err = binary.Read(s.conn, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+	if stream == nil {
+		return common.Error(io.CopyN(io.Discard, s.conn, int64(length)))
+	}
+	data := buf.NewSize(int(length))
+	_, err = data.ReadFullFrom(s.conn, int(length))
+	if err != nil {
+		data.Release()
+		return err
+	}
+	if !destination.IsValid() {
+		destination = stream.destination
+	}
+	err = stream.buffer.push(data, destination)
+	if err == ErrMuxBufferFull && stream.network == NetworkUDP {
+		return nil
+	}
+	if err != nil {
+		s.closeStream(stream, err, true)
+	}
+	return nil
+}
+
+func (s *clientSession) writeFrame(sessionID uint16, status byte, option byte, network byte, destination M.Socksaddr, data []byte) error {
+	metaLen := 4
+	if network != 0 {
+		metaLen += 1 + AddressSerializer.AddrPortLen(destination)
+	}
+	frameLen := 2 + metaLen
+	if option&OptionData != 0 {
+		frameLen += 2 + len(data)
+	}
+	buffer := buf.NewSize(frameLen)
+	defer buffer.Release()
+	common.Must(
+		binary.Write(buffer, binary.BigEndian, uint16(metaLen)),
+		binary.Write(buffer, binary.BigEndian, sessionID),
+		buffer.WriteByte(status),
+		buffer.WriteByte(option),
+	)
+	if network != 0 {
+		common.Must(buffer.WriteByte(network))
+		err := AddressSerializer.WriteAddrPort(buffer, destination)
+		if err != nil {
+			return err
+		}
+	}
+	if option&OptionData != 0 {
+		common.Must(
+			binary.Write(buffer, binary.BigEndian, uint16(len(data))),
+			common.Error(buffer.Write(data)),
+		)
+	}
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	return common.Error(s.conn.Write(buffer.Bytes()))
+}
+
+func (s *clientStream) write(data []byte, destination M.Socksaddr) error {
+	if s.done.Load() {
+		return io.ErrClosedPipe
+	}
+	if s.network == NetworkTCP {
+		return s.session.writeFrame(s.sessionID, StatusKeep, OptionData, 0, M.Socksaddr{}, data)
+	}
+	return s.session.writeFrame(s.sessionID, StatusKeep, OptionData, NetworkUDP, destination, data)
+}
+
+func (s *clientStream) closeWithError(err error) {
+	s.done.Store(true)
+	s.buffer.closeWithError(err)
+}
+
+func (s *clientStream) Close() error {
+	s.session.closeStream(s, nil, true)
+	return nil
+}
+
+func (s *clientStream) LocalAddr() net.Addr {
+	return M.Socksaddr{}
+}
+
+func (s *clientStream) SetDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (s *clientStream) SetReadDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (s *clientStream) SetWriteDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (s *clientStream) NeedAdditionalReadDeadline() bool {
+	return true
+}
+
+type clientMuxConn struct {
+	*clientStream
+}
+
+func (c *clientMuxConn) Read(b []byte) (n int, err error) {
+	return c.buffer.Read(b)
+}
+
+func (c *clientMuxConn) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > muxFrameSize {
+			chunk = chunk[:muxFrameSize]
+		}
+		err = c.write(chunk, M.Socksaddr{})
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+	}
+	return
+}
+
+// CloseWrite sends StatusEnd while the stream can still be read.
+func (c *clientMuxConn) CloseWrite() error {
+	return c.session.closeWrite(c.clientStream)
+}
+
+func (c *clientMuxConn) RemoteAddr() net.Addr {
+	return c.destination
+}
+
+var _ PacketConn = (*clientMuxPacketConn)(nil)
+
+type clientMuxPacketConn struct {
+	*clientStream
+}
+
+func (c *clientMuxPacketConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(b)
+	return
+}
+
+func (c *clientMuxPacketConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.destination)
+}
+
+func (c *clientMuxPacketConn) RemoteAddr() net.Addr {
+	return c.destination.UDPAddr()
+}
+
+func (c *clientMuxPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buffer := buf.With(p)
+	destination, err := c.ReadPacket(buffer)
+	if err != nil {
+		return
+	}
+	if destination.IsFqdn() {
+		addr = destination
+	} else {
+		addr = destination.UDPAddr()
+	}
+	n = buffer.Len()
+	return
+}
+
+func (c *clientMuxPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	packet, err := c.buffer.readPacket()
+	if err != nil {
+		return
+	}
+	defer packet.buffer.Release()
+	if packet.buffer.Len() > buffer.FreeLen() {
+		return M.Socksaddr{}, E.Extend(io.ErrShortBuffer, "mux need ", packet.buffer.Len())
+	}
+	common.Must1(buffer.Write(packet.buffer.Bytes()))
+	return packet.destination.Unwrap(), nil
+}
+
+func (c *clientMuxPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	err = c.WritePacket(buf.As(p), M.SocksaddrFromNet(addr))
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *clientMuxPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	if buffer.Len() > math.MaxUint16 {
+		return E.New("mux packet too large: ", buffer.Len())
+	}
+	return c.write(buffer.Bytes(), destination)
+}
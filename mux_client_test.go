@@ -0,0 +1,121 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestMuxClientRoundTrip(t *testing.T) {
+	t.Parallel()
+	address := startTestMuxServer(t, testEchoHandler{})
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	payload := make([]byte, 256*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			go conn.Write(payload)
+			response := make([]byte, len(payload))
+			_, err := io.ReadFull(conn, response)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(response, payload) {
+				t.Error("bad TCP payload")
+			}
+		}()
+	}
+	wg.Wait()
+
+	packetConn, err := client.DialPacketConn(context.Background(), M.ParseSocksaddr("1.1.1.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	destination := M.ParseSocksaddr("8.8.8.8:53")
+	_, err = packetConn.WriteTo([]byte("ping"), destination.UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 64)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response[:n]) != "ping" || M.SocksaddrFromNet(addr) != destination {
+		t.Fatal("bad UDP response ", string(response[:n]), " from ", addr)
+	}
+}
+
+func TestMuxClientSharedDial(t *testing.T) {
+	t.Parallel()
+	address := startTestMuxServer(t, testEchoHandler{})
+	client, dials := newTestMuxClient(t, address, MuxClientOptions{MaxConcurrency: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dials.Load() != 3 || client.Connections() != 3 {
+		t.Fatal("dialed ", dials.Load(), " connections for 5 streams, expected 3")
+	}
+}
+
+func TestMuxClientIdleTimeout(t *testing.T) {
+	t.Parallel()
+	address := startTestMuxServer(t, testEchoHandler{})
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{IdleTimeout: 100 * time.Millisecond})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if client.Connections() != 1 {
+		t.Fatal("closed a connection with a stream")
+	}
+	_ = conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for client.Connections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err = client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || string(response) != "ping" {
+		t.Fatal("redial failed: ", err)
+	}
+}
@@ -0,0 +1,116 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// testReplyHandler reads its TCP streams until EOF, then replies with everything it has read.
+type testReplyHandler struct {
+	testEchoHandler
+}
+
+func (testReplyHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		defer conn.Close()
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte("reply:"), request...))
+	}()
+}
+
+// testGreetingHandler writes greeting and closes its side of TCP streams, then reads them until EOF.
+type testGreetingHandler struct {
+	testEchoHandler
+	greeting []byte
+	received chan []byte
+}
+
+func (h testGreetingHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		defer conn.Close()
+		_, err := conn.Write(h.greeting)
+		if err != nil {
+			return
+		}
+		err = N.CloseWrite(conn)
+		if err != nil {
+			return
+		}
+		request, _ := io.ReadAll(conn)
+		h.received <- request
+	}()
+}
+
+func TestMuxClientCloseWrite(t *testing.T) {
+	t.Parallel()
+	address := startTestMuxServer(t, testReplyHandler{})
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = N.CloseWrite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("late"))
+	if err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "reply:hello" {
+		t.Fatal("bad reply ", string(response))
+	}
+}
+
+func TestMuxServerCloseWrite(t *testing.T) {
+	t.Parallel()
+	greeting := make([]byte, 256*1024)
+	for i := range greeting {
+		greeting[i] = byte(i)
+	}
+	handler := testGreetingHandler{greeting: greeting, received: make(chan []byte, 1)}
+	address := startTestMuxServer(t, handler)
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Every frame sent before the server closed its side is read before EOF.
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, greeting) {
+		t.Fatal("bad greeting of ", len(response), " bytes")
+	}
+	_, err = conn.Write([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = N.CloseWrite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request := <-handler.received; string(request) != "after" {
+		t.Fatal("bad request ", string(request))
+	}
+}
@@ -0,0 +1,127 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const testUserID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+type testEchoHandler struct{}
+
+func (testEchoHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+}
+
+func (testEchoHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		_, _ = bufio.CopyPacket(conn, conn)
+		_ = conn.Close()
+	}()
+}
+
+func startTestMuxServer(t *testing.T, handler Handler, options ...ServiceOption) string {
+	return startTestServer(t, newTestService(t, handler, options...))
+}
+
+func startTestServer(t *testing.T, service *Service[string]) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				err := service.NewConnection(context.Background(), conn, M.SocksaddrFromNet(conn.RemoteAddr()), nil)
+				if err != nil {
+					_ = conn.Close()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestMuxClient(t *testing.T, address string, options MuxClientOptions) (*MuxClient, *atomic.Int32) {
+	client, err := NewClient(testUserID, "aes-128-gcm", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dials atomic.Int32
+	muxClient := NewMuxClient(func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return client.DialMuxConn(conn)
+	}, options)
+	t.Cleanup(func() {
+		_ = muxClient.Close()
+	})
+	return muxClient, &dials
+}
+
+func TestMuxKeepAliveConcurrentWrites(t *testing.T) {
+	t.Parallel()
+	address := startTestMuxServer(t, testEchoHandler{}, ServiceWithMuxPolicy(MuxPolicy{KeepAliveInterval: time.Millisecond}))
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packetConn, err := client.DialPacketConn(context.Background(), M.ParseSocksaddr("1.1.1.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	payload := bytes.Repeat([]byte("keepalive"), 16*1024)
+	done := make(chan error, 1)
+	go func() {
+		go conn.Write(payload)
+		response := make([]byte, len(payload))
+		_, err := io.ReadFull(conn, response)
+		if err == nil && !bytes.Equal(response, payload) {
+			err = io.ErrUnexpectedEOF
+		}
+		done <- err
+	}()
+	response := make([]byte, 64)
+	for i := 0; i < 200; i++ {
+		_, err = packetConn.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := packetConn.Read(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response[:n]) != "ping" {
+			t.Fatal("bad UDP response ", string(response[:n]))
+		}
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
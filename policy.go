@@ -0,0 +1,81 @@
+package vmess
+
+import (
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrPolicyViolation = E.New("policy violation")
+
+// SecurityPolicy restricts what an authenticated client may request.
+// The zero value accepts everything.
+type SecurityPolicy struct {
+	// AllowedSecurity lists the accepted security types, all are accepted if empty.
+	AllowedSecurity []byte
+	// RequireChunkStream rejects TCP requests without chunk framing,
+	// such as the "zero" security.
+	RequireChunkStream bool
+	// RequireAuthenticatedLength rejects requests without RequestOptionAuthenticatedLength.
+	RequireAuthenticatedLength bool
+	// RequireGlobalPadding rejects requests without RequestOptionGlobalPadding.
+	RequireGlobalPadding bool
+	// DisableLegacy rejects legacy (alterId) handshakes, leaving AEAD only.
+	DisableLegacy bool
+	// DisableTCP and DisableUDP also apply to mux streams.
+	DisableTCP bool
+	DisableUDP bool
+	DisableMux bool
+}
+
+func (p *SecurityPolicy) checkLegacy() error {
+	if p != nil && p.DisableLegacy {
+		return E.Extend(ErrPolicyViolation, "legacy protocol not allowed")
+	}
+	return nil
+}
+
+func (p *SecurityPolicy) checkRequest(security byte, option byte, command byte) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowedSecurity) > 0 {
+		var allowed bool
+		for _, allowedSecurity := range p.AllowedSecurity {
+			if allowedSecurity == security {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return E.Extend(ErrPolicyViolation, "security type not allowed: ", security)
+		}
+	}
+	if p.RequireChunkStream && command == CommandTCP && option&RequestOptionChunkStream == 0 {
+		return E.Extend(ErrPolicyViolation, "chunk stream required")
+	}
+	if p.RequireAuthenticatedLength && option&RequestOptionAuthenticatedLength == 0 {
+		return E.Extend(ErrPolicyViolation, "authenticated length required")
+	}
+	if p.RequireGlobalPadding && option&RequestOptionGlobalPadding == 0 {
+		return E.Extend(ErrPolicyViolation, "global padding required")
+	}
+	return p.checkCommand(command)
+}
+
+func (p *SecurityPolicy) checkCommand(command byte) error {
+	if p == nil {
+		return nil
+	}
+	var disabled bool
+	switch command {
+	case CommandTCP:
+		disabled = p.DisableTCP
+	case CommandUDP:
+		disabled = p.DisableUDP
+	case CommandMux:
+		disabled = p.DisableMux
+	}
+	if disabled {
+		return E.Extend(ErrPolicyViolation, "command not allowed: ", command)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package vmess
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var ErrSourceBanned = E.New("source banned")
+
+const (
+	DefaultProbeMaxFailures = 10
+	DefaultProbeWindow      = time.Minute
+	DefaultProbeBanDuration = 10 * time.Minute
+)
+
+type ProbeGuardOptions struct {
+	// MaxFailures is the number of failed handshakes within Window that bans a source prefix.
+	MaxFailures int
+	Window      time.Duration
+	BanDuration time.Duration
+	// IPv4PrefixLen and IPv6PrefixLen are the prefix lengths failures are counted by, the defaults are 32 and 64.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	// TimeFunc defaults to time.Now.
+	TimeFunc TimeFunc
+}
+
+// Ban is an active ban of a source prefix.
+type Ban struct {
+	Prefix netip.Prefix
+	Until  time.Time
+	// Failures is the number of failures that caused the ban, zero for bans added with ProbeGuard.Ban.
+	Failures int
+}
+
+// ProbeGuard counts failed handshakes per source prefix over a sliding window, and bans prefixes
+// that fail too often. Connections from banned prefixes are rejected before authentication,
+// so scanners do not cost a user lookup each.
+type ProbeGuard struct {
+	options   ProbeGuardOptions
+	access    sync.Mutex
+	failures  map[netip.Prefix][]time.Time
+	bans      map[netip.Prefix]Ban
+	ranges    map[netip.Prefix]Ban
+	lastSweep time.Time
+}
+
+func NewProbeGuard(options ProbeGuardOptions) *ProbeGuard {
+	if options.MaxFailures <= 0 {
+		options.MaxFailures = DefaultProbeMaxFailures
+	}
+	if options.Window <= 0 {
+		options.Window = DefaultProbeWindow
+	}
+	if options.BanDuration <= 0 {
+		options.BanDuration = DefaultProbeBanDuration
+	}
+	if options.IPv4PrefixLen <= 0 || options.IPv4PrefixLen > 32 {
+		options.IPv4PrefixLen = 32
+	}
+	if options.IPv6PrefixLen <= 0 || options.IPv6PrefixLen > 128 {
+		options.IPv6PrefixLen = 64
+	}
+	if options.TimeFunc == nil {
+		options.TimeFunc = time.Now
+	}
+	return &ProbeGuard{
+		options:  options,
+		failures: make(map[netip.Prefix][]time.Time),
+		bans:     make(map[netip.Prefix]Ban),
+		ranges:   make(map[netip.Prefix]Ban),
+	}
+}
+
+func (g *ProbeGuard) sourcePrefix(source M.Socksaddr) (netip.Prefix, bool) {
+	if !source.IsIP() {
+		return netip.Prefix{}, false
+	}
+	addr := source.Addr.Unmap()
+	bits := g.options.IPv6PrefixLen
+	if addr.Is4() {
+		bits = g.options.IPv4PrefixLen
+	}
+	prefix, err := addr.Prefix(bits)
+	return prefix, err == nil
+}
+
+// Banned reports whether source belongs to a banned prefix.
+func (g *ProbeGuard) Banned(source M.Socksaddr) bool {
+	if g == nil {
+		return false
+	}
+	prefix, ok := g.sourcePrefix(source)
+	if !ok {
+		return false
+	}
+	now := g.options.TimeFunc()
+	g.access.Lock()
+	defer g.access.Unlock()
+	if ban, loaded := g.bans[prefix]; loaded {
+		if now.Before(ban.Until) {
+			return true
+		}
+		delete(g.bans, prefix)
+	}
+	for rangePrefix, ban := range g.ranges {
+		if !now.Before(ban.Until) {
+			delete(g.ranges, rangePrefix)
+		} else if rangePrefix.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail records a failed handshake from source, it reports whether the prefix of source got banned by it.
+func (g *ProbeGuard) Fail(source M.Socksaddr) bool {
+	if g == nil {
+		return false
+	}
+	prefix, ok := g.sourcePrefix(source)
+	if !ok {
+		return false
+	}
+	now := g.options.TimeFunc()
+	g.access.Lock()
+	defer g.access.Unlock()
+	g.sweep(now)
+	failures := append(g.failures[prefix], now)
+	if len(failures) > g.options.MaxFailures {
+		failures = failures[len(failures)-g.options.MaxFailures:]
+	}
+	if len(failures) < g.options.MaxFailures || now.Sub(failures[0]) > g.options.Window {
+		g.failures[prefix] = failures
+		return false
+	}
+	delete(g.failures, prefix)
+	g.bans[prefix] = Ban{
+		Prefix:   prefix,
+		Until:    now.Add(g.options.BanDuration),
+		Failures: len(failures),
+	}
+	return true
+}
+
+// sweep forgets expired bans and failures outside the window, at most once per window.
+func (g *ProbeGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.options.Window {
+		return
+	}
+	g.lastSweep = now
+	for prefix, failures := range g.failures {
+		if now.Sub(failures[len(failures)-1]) > g.options.Window {
+			delete(g.failures, prefix)
+		}
+	}
+	for prefix, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, prefix)
+		}
+	}
+	for prefix, ban := range g.ranges {
+		if !now.Before(ban.Until) {
+			delete(g.ranges, prefix)
+		}
+	}
+}
+
+// Ban bans prefix for duration, the default ban duration if zero. The prefix may have any length.
+func (g *ProbeGuard) Ban(prefix netip.Prefix, duration time.Duration) {
+	if duration <= 0 {
+		duration = g.options.BanDuration
+	}
+	prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+	ban := Ban{
+		Prefix: prefix,
+		Until:  g.options.TimeFunc().Add(duration),
+	}
+	g.access.Lock()
+	defer g.access.Unlock()
+	if g.isSourcePrefix(prefix) {
+		g.bans[prefix] = ban
+	} else {
+		g.ranges[prefix] = ban
+	}
+}
+
+// Unban removes the ban and the recorded failures of prefix, it reports whether prefix was banned.
+func (g *ProbeGuard) Unban(prefix netip.Prefix) bool {
+	prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+	g.access.Lock()
+	defer g.access.Unlock()
+	delete(g.failures, prefix)
+	_, banned := g.bans[prefix]
+	delete(g.bans, prefix)
+	if _, loaded := g.ranges[prefix]; loaded {
+		banned = true
+		delete(g.ranges, prefix)
+	}
+	return banned
+}
+
+// Bans returns the active bans.
+func (g *ProbeGuard) Bans() []Ban {
+	now := g.options.TimeFunc()
+	g.access.Lock()
+	defer g.access.Unlock()
+	bans := make([]Ban, 0, len(g.bans)+len(g.ranges))
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	for _, ban := range g.ranges {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+func (g *ProbeGuard) isSourcePrefix(prefix netip.Prefix) bool {
+	if prefix.Addr().Is4() {
+		return prefix.Bits() == g.options.IPv4PrefixLen
+	}
+	return prefix.Bits() == g.options.IPv6PrefixLen
+}
+
+// Observe records a RejectError as a failure if it was caused by the content of the request.
+// Replayed or tampered handshakes count even if they carry a valid auth ID, other rejections
+// of authenticated users, transport errors, timeouts and user store failures do not.
+func (g *ProbeGuard) Observe(err error) {
+	var rejectErr *RejectError
+	if g == nil || !errors.As(err, &rejectErr) {
+		return
+	}
+	switch rejectErr.Reason {
+	case RejectReasonReplay, RejectReasonDecrypt:
+	case RejectReasonBadHeader, RejectReasonUnknownUser, RejectReasonBadVersion, RejectReasonBadChecksum,
+		RejectReasonBadSecurity, RejectReasonBadOption, RejectReasonBadCommand, RejectReasonBadAddress:
+		if rejectErr.User != nil {
+			return
+		}
+	default:
+		return
+	}
+	g.Fail(rejectErr.Source)
+}
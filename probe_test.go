@@ -0,0 +1,146 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// handshakeTestService sends a request of userId to service, and returns the error the connection is rejected with.
+func handshakeTestService(t *testing.T, service *Service[string], userId string) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.NewConnection(context.Background(), server, M.ParseSocksaddr("127.0.0.1:1000"), nil)
+		_ = server.Close()
+	}()
+	vmessClient, err := NewClient(userId, "aes-128-gcm", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := vmessClient.DialEarlyConn(client, M.ParseSocksaddr("example.com:80"))
+	go conn.Write([]byte("request"))
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("request not rejected")
+		return nil
+	}
+}
+
+func TestProbeGuardBan(t *testing.T) {
+	t.Parallel()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	guard := NewProbeGuard(ProbeGuardOptions{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BanDuration: 10 * time.Minute,
+		TimeFunc:    clock.Now,
+	})
+	source := M.ParseSocksaddr("192.0.2.1:1000")
+	guard.Fail(source)
+	guard.Fail(source)
+	clock.Add(2 * time.Minute)
+	if guard.Fail(source) || guard.Banned(source) {
+		t.Fatal("banned for failures outside the window")
+	}
+	guard.Fail(source)
+	if !guard.Fail(source) || !guard.Banned(source) {
+		t.Fatal("not banned after the maximum failures")
+	}
+	if guard.Banned(M.ParseSocksaddr("192.0.2.2:1000")) {
+		t.Fatal("banned another source")
+	}
+	clock.Add(10 * time.Minute)
+	if guard.Banned(source) {
+		t.Fatal("banned after the ban duration")
+	}
+
+	guard.Ban(netip.MustParsePrefix("198.51.100.0/24"), 0)
+	if !guard.Banned(M.ParseSocksaddr("198.51.100.7:1000")) {
+		t.Fatal("source in a banned range not banned")
+	}
+	if !guard.Unban(netip.MustParsePrefix("198.51.100.0/24")) || guard.Banned(M.ParseSocksaddr("198.51.100.7:1000")) {
+		t.Fatal("range not unbanned")
+	}
+}
+
+func TestProbeGuardObserve(t *testing.T) {
+	t.Parallel()
+	source := M.ParseSocksaddr("192.0.2.1:1000")
+	for _, testCase := range []struct {
+		reason RejectReason
+		user   any
+		counts bool
+	}{
+		{RejectReasonUnknownUser, nil, true},
+		{RejectReasonBadHeader, nil, true},
+		{RejectReasonBadHeader, "test", false},
+		{RejectReasonReplay, "test", true},
+		{RejectReasonUserStore, nil, false},
+		{RejectReasonTimeout, nil, false},
+		{RejectReasonConnection, nil, false},
+	} {
+		guard := NewProbeGuard(ProbeGuardOptions{MaxFailures: 1})
+		guard.Observe(&RejectError{Protocol: "vmess", Reason: testCase.reason, User: testCase.user, Source: source})
+		if guard.Banned(source) != testCase.counts {
+			t.Error(testCase.reason, " with user ", testCase.user, ": banned ", !testCase.counts)
+		}
+	}
+}
+
+func TestServiceProbeBan(t *testing.T) {
+	t.Parallel()
+	service := newTestService(t, testEchoHandler{})
+	guard := NewProbeGuard(ProbeGuardOptions{MaxFailures: 2})
+	service.SetProbeGuard(guard)
+	unknownUser := uuid.Must(uuid.NewV4()).String()
+	for i := 0; i < 2; i++ {
+		var rejectErr *RejectError
+		err := handshakeTestService(t, service, unknownUser)
+		if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectReasonUnknownUser {
+			t.Fatal("expected an unknown user, got ", err)
+		}
+	}
+	var rejectErr *RejectError
+	err := handshakeTestService(t, service, testUserID)
+	if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectReasonBanned {
+		t.Fatal("expected a banned source, got ", err)
+	}
+}
+
+func TestServiceUserStoreFailure(t *testing.T) {
+	t.Parallel()
+	loadErr := errors.New("database down")
+	source := &testUserSource{
+		users: map[string][]Credential{"test": {{UUID: testUserID}}},
+		err:   loadErr,
+	}
+	store := NewCachedUserStore[string](source, CachedUserStoreOptions{RetryInterval: time.Hour})
+	service := NewService[string](testEchoHandler{})
+	service.SetUserStore(store)
+	guard := NewProbeGuard(ProbeGuardOptions{MaxFailures: 1})
+	service.SetProbeGuard(guard)
+	waitFor(t, func() bool {
+		err := handshakeTestService(t, service, testUserID)
+		return errors.Is(err, loadErr)
+	}, "load failure not reported")
+	for i := 0; i < 3; i++ {
+		var rejectErr *RejectError
+		err := handshakeTestService(t, service, testUserID)
+		if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectReasonUserStore || !errors.Is(err, ErrUserStore) {
+			t.Fatal("expected a store failure, got ", err)
+		}
+	}
+	if len(guard.Bans()) != 0 {
+		t.Fatal("source banned for store failures")
+	}
+}
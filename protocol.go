@@ -129,7 +129,7 @@ func AuthID(key [16]byte, time time.Time, buffer *buf.Buffer) {
 	common.Must(binary.Write(buffer, binary.BigEndian, time.Unix()))
 	buffer.WriteRandom(4)
 	common.Must(binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes())))
-	aesBlock, err := aes.NewCipher(KDF(key[:], KDFSaltConstAuthIDEncryptionKey)[:16])
+	aesBlock, err := NewAuthIDCipher(key)
 	common.Must(err)
 	aesBlock.Encrypt(buffer.Bytes(), buffer.Bytes())
 }
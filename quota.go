@@ -0,0 +1,257 @@
+package vmess
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var (
+	ErrUserExpired   = E.New("user expired")
+	ErrQuotaExceeded = E.New("traffic quota exceeded")
+)
+
+// QuotaStore loads and persists the traffic usage of users.
+type QuotaStore[U comparable] interface {
+	// LoadUsage returns the bytes used by user so far.
+	LoadUsage(user U) (int64, error)
+	// StoreUsage persists the bytes used by user.
+	StoreUsage(user U, usage int64) error
+}
+
+type UserQuota struct {
+	// ExpireAt is the time after which new connections of the user are rejected and live ones are closed,
+	// zero never expires.
+	ExpireAt time.Time
+	// Bytes is the allowed payload traffic, uploads and downloads combined, zero is unlimited.
+	Bytes int64
+}
+
+// QuotaManager enforces user expiration and traffic quotas. New connections of users
+// over their quota are rejected, and live connections are closed when a quota runs out or the user expires.
+type QuotaManager[U comparable] struct {
+	access   sync.RWMutex
+	store    QuotaStore[U]
+	time     TimeFunc
+	users    map[U]*userQuota
+	trackers []*ConnTracker[U]
+}
+
+type userQuota struct {
+	expireAt    time.Time
+	expireTimer *time.Timer
+	bytes       int64
+	used        int64
+	stored      int64
+	exceeded    uint32
+}
+
+// NewQuotaManager creates a quota manager, store may be nil to keep usage in memory only.
+func NewQuotaManager[U comparable](store QuotaStore[U], timeFunc TimeFunc) *QuotaManager[U] {
+	if timeFunc == nil {
+		timeFunc = time.Now
+	}
+	return &QuotaManager[U]{
+		store: store,
+		time:  timeFunc,
+		users: make(map[U]*userQuota),
+	}
+}
+
+// SetUser sets the quota of user, the usage is loaded from the store when the user is first set.
+func (m *QuotaManager[U]) SetUser(user U, quota UserQuota) error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	state := m.users[user]
+	if state == nil {
+		state = new(userQuota)
+		if m.store != nil {
+			usage, err := m.store.LoadUsage(user)
+			if err != nil {
+				return E.Cause(err, "load usage of ", user)
+			}
+			state.used = usage
+			state.stored = usage
+		}
+		m.users[user] = state
+	}
+	state.expireAt = quota.ExpireAt
+	if state.expireTimer != nil {
+		state.expireTimer.Stop()
+		state.expireTimer = nil
+	}
+	if !quota.ExpireAt.IsZero() {
+		expireAt := quota.ExpireAt
+		state.expireTimer = time.AfterFunc(expireAt.Sub(m.time()), func() {
+			m.expire(user, state, expireAt)
+		})
+	}
+	atomic.StoreInt64(&state.bytes, quota.Bytes)
+	if quota.Bytes <= 0 || atomic.LoadInt64(&state.used) < quota.Bytes {
+		atomic.StoreUint32(&state.exceeded, 0)
+	}
+	return nil
+}
+
+// RemoveUser forgets the quota of user, it does not persist the usage.
+func (m *QuotaManager[U]) RemoveUser(user U) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	if state := m.users[user]; state != nil && state.expireTimer != nil {
+		state.expireTimer.Stop()
+	}
+	delete(m.users, user)
+}
+
+// Usage returns the bytes used by user.
+func (m *QuotaManager[U]) Usage(user U) int64 {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	state := m.users[user]
+	if state == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&state.used)
+}
+
+// ResetUsage sets the usage of user to zero, for example at the start of a billing period.
+func (m *QuotaManager[U]) ResetUsage(user U) {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	state := m.users[user]
+	if state == nil {
+		return
+	}
+	atomic.StoreInt64(&state.used, 0)
+	atomic.StoreUint32(&state.exceeded, 0)
+}
+
+// Flush persists the usage of all users that changed since the last flush.
+func (m *QuotaManager[U]) Flush() error {
+	if m.store == nil {
+		return nil
+	}
+	m.access.RLock()
+	defer m.access.RUnlock()
+	var errors []error
+	for user, state := range m.users {
+		err := m.storeUsage(user, state)
+		if err != nil {
+			errors = append(errors, err)
+		}
+	}
+	return E.Errors(errors...)
+}
+
+func (m *QuotaManager[U]) storeUsage(user U, state *userQuota) error {
+	used := atomic.LoadInt64(&state.used)
+	stored := atomic.SwapInt64(&state.stored, used)
+	if stored == used {
+		return nil
+	}
+	err := m.store.StoreUsage(user, used)
+	if err != nil {
+		atomic.CompareAndSwapInt64(&state.stored, used, stored)
+	}
+	return err
+}
+
+// AttachTracker makes the manager close the connections of tracker when a user runs out of quota.
+func (m *QuotaManager[U]) AttachTracker(tracker *ConnTracker[U]) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.trackers = append(m.trackers, tracker)
+}
+
+// Check returns an error if user is expired or over quota.
+func (m *QuotaManager[U]) Check(user U) error {
+	if m == nil {
+		return nil
+	}
+	m.access.RLock()
+	defer m.access.RUnlock()
+	state := m.users[user]
+	if state == nil {
+		return nil
+	}
+	if !state.expireAt.IsZero() && m.time().After(state.expireAt) {
+		return ErrUserExpired
+	}
+	if bytes := atomic.LoadInt64(&state.bytes); bytes > 0 && atomic.LoadInt64(&state.used) >= bytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (m *QuotaManager[U]) counter(user U) N.CountFunc {
+	m.access.RLock()
+	state := m.users[user]
+	m.access.RUnlock()
+	if state == nil {
+		return nil
+	}
+	return func(n int64) {
+		used := atomic.AddInt64(&state.used, n)
+		if bytes := atomic.LoadInt64(&state.bytes); bytes > 0 && used >= bytes && atomic.CompareAndSwapUint32(&state.exceeded, 0, 1) {
+			go m.exceed(user, state)
+		}
+	}
+}
+
+func (m *QuotaManager[U]) exceed(user U, state *userQuota) {
+	m.access.RLock()
+	trackers := m.trackers
+	m.access.RUnlock()
+	for _, tracker := range trackers {
+		tracker.CloseUser(user, ErrQuotaExceeded)
+	}
+	if m.store != nil {
+		_ = m.storeUsage(user, state)
+	}
+}
+
+// expire closes the connections of user once its expiration set to expireAt passes,
+// unless the user was removed or its expiration changed since.
+func (m *QuotaManager[U]) expire(user U, state *userQuota, expireAt time.Time) {
+	m.access.RLock()
+	trackers := m.trackers
+	current := m.users[user] == state && state.expireAt.Equal(expireAt)
+	m.access.RUnlock()
+	if !current {
+		return
+	}
+	for _, tracker := range trackers {
+		tracker.CloseUser(user, ErrUserExpired)
+	}
+}
+
+// WrapConn counts the payload of conn to the quota of user,
+// it returns conn unchanged if m is nil or user has no quota.
+func (m *QuotaManager[U]) WrapConn(user U, conn net.Conn) net.Conn {
+	if m == nil {
+		return conn
+	}
+	counter := m.counter(user)
+	if counter == nil {
+		return conn
+	}
+	return bufio.NewCounterConn(conn, []N.CountFunc{counter}, []N.CountFunc{counter})
+}
+
+// WrapPacketConn counts the payload of conn to the quota of user,
+// it returns conn unchanged if m is nil or user has no quota.
+func (m *QuotaManager[U]) WrapPacketConn(user U, conn N.PacketConn) N.PacketConn {
+	if m == nil {
+		return conn
+	}
+	counter := m.counter(user)
+	if counter == nil {
+		return conn
+	}
+	return bufio.NewCounterPacketConn(conn, []N.CountFunc{counter}, []N.CountFunc{counter})
+}
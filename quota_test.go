@@ -0,0 +1,91 @@
+package vmess
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testQuotaStore struct {
+	access sync.Mutex
+	usage  map[string]int64
+}
+
+func (s *testQuotaStore) LoadUsage(user string) (int64, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.usage[user], nil
+}
+
+func (s *testQuotaStore) StoreUsage(user string, usage int64) error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.usage[user] = usage
+	return nil
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	t.Parallel()
+	store := &testQuotaStore{usage: map[string]int64{"test": 512}}
+	manager := NewQuotaManager[string](store, nil)
+	err := manager.SetUser("test", UserQuota{Bytes: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newTestService(t, testEchoHandler{})
+	service.SetQuotaManager(manager)
+	address := startTestServer(t, service)
+	conn := dialTestConn(t, address)
+	defer conn.Close()
+	go conn.Write(bytes.Repeat([]byte{'x'}, 8192))
+	// The echo never ends unless the server closes the connection.
+	_, _ = io.Copy(io.Discard, conn)
+	if !errors.Is(manager.Check("test"), ErrQuotaExceeded) {
+		t.Fatal("quota not exceeded after ", manager.Usage("test"), " bytes")
+	}
+	waitFor(t, func() bool {
+		usage, _ := store.LoadUsage("test")
+		return usage >= 4096
+	}, "usage not stored when the quota ran out")
+	conn = dialTestConn(t, address)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("accepted a connection over quota")
+	}
+	manager.ResetUsage("test")
+	conn = dialTestConn(t, address)
+	defer conn.Close()
+	testMuxEcho(t, conn)
+}
+
+func TestQuotaExpire(t *testing.T) {
+	t.Parallel()
+	manager := NewQuotaManager[string](nil, nil)
+	err := manager.SetUser("test", UserQuota{ExpireAt: time.Now().Add(200 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newTestService(t, testEchoHandler{})
+	service.SetQuotaManager(manager)
+	address := startTestServer(t, service)
+	conn := dialTestConn(t, address)
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection of an expired user still open")
+	}
+	if !errors.Is(manager.Check("test"), ErrUserExpired) {
+		t.Fatal("user not expired")
+	}
+	conn = dialTestConn(t, address)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("accepted a connection of an expired user")
+	}
+}
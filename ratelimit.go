@@ -0,0 +1,212 @@
+package vmess
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// RateLimiter limits the payload throughput of each user across all of its connections and mux streams.
+// Changed limits apply to live connections.
+type RateLimiter[U comparable] struct {
+	access  sync.RWMutex
+	buckets map[U]*userBuckets
+}
+
+type userBuckets struct {
+	upload   tokenBucket
+	download tokenBucket
+}
+
+func NewRateLimiter[U comparable]() *RateLimiter[U] {
+	return &RateLimiter[U]{
+		buckets: make(map[U]*userBuckets),
+	}
+}
+
+// SetLimit sets the upload and download limits of user in bytes per second, zero means unlimited.
+func (l *RateLimiter[U]) SetLimit(user U, upload int64, download int64) {
+	if upload <= 0 && download <= 0 {
+		l.Remove(user)
+		return
+	}
+	l.access.Lock()
+	buckets := l.buckets[user]
+	if buckets == nil {
+		buckets = new(userBuckets)
+		l.buckets[user] = buckets
+	}
+	l.access.Unlock()
+	buckets.upload.setRate(upload)
+	buckets.download.setRate(download)
+}
+
+// Remove forgets the limits of user, its live connections are no longer limited.
+func (l *RateLimiter[U]) Remove(user U) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	delete(l.buckets, user)
+}
+
+func (l *RateLimiter[U]) waitFunc(user U, upload bool, done <-chan struct{}) N.CountFunc {
+	return func(n int64) {
+		l.access.RLock()
+		buckets := l.buckets[user]
+		l.access.RUnlock()
+		if buckets == nil {
+			return
+		}
+		if upload {
+			buckets.upload.wait(n, done)
+		} else {
+			buckets.download.wait(n, done)
+		}
+	}
+}
+
+// WrapConn limits the payload of conn by the limits of user, it returns conn unchanged if l is nil.
+func (l *RateLimiter[U]) WrapConn(user U, conn net.Conn) net.Conn {
+	return l.wrapConn(user, conn, true, true)
+}
+
+// WrapPacketConn limits the payload of conn by the limits of user, it returns conn unchanged if l is nil.
+func (l *RateLimiter[U]) WrapPacketConn(user U, conn N.PacketConn) N.PacketConn {
+	return l.wrapPacketConn(user, conn, true, true)
+}
+
+// LimitMuxConn limits the upload of the mux connection conn by the limits of user.
+// Frames are limited before they are demultiplexed, so a limited stream slows down the connection
+// instead of overflowing its stream buffer. It must be called before conn is tracked,
+// and the streams of conn must be wrapped with WrapMuxStream and WrapMuxPacketStream.
+func (l *RateLimiter[U]) LimitMuxConn(user U, conn *TrackedConn) {
+	if l == nil {
+		return
+	}
+	conn.Conn = l.wrapConn(user, conn.Conn, true, false)
+}
+
+// WrapMuxStream limits the download of a stream of a connection limited by LimitMuxConn.
+func (l *RateLimiter[U]) WrapMuxStream(user U, conn net.Conn) net.Conn {
+	return l.wrapConn(user, conn, false, true)
+}
+
+// WrapMuxPacketStream limits the download of a stream of a connection limited by LimitMuxConn.
+func (l *RateLimiter[U]) WrapMuxPacketStream(user U, conn N.PacketConn) N.PacketConn {
+	return l.wrapPacketConn(user, conn, false, true)
+}
+
+func (l *RateLimiter[U]) wrapConn(user U, conn net.Conn, upload bool, download bool) net.Conn {
+	if l == nil {
+		return conn
+	}
+	limitedConn := &rateLimitedConn{done: make(chan struct{})}
+	var readCounter, writeCounter []N.CountFunc
+	if upload {
+		readCounter = []N.CountFunc{l.waitFunc(user, true, limitedConn.done)}
+	}
+	if download {
+		writeCounter = []N.CountFunc{l.waitFunc(user, false, limitedConn.done)}
+	}
+	limitedConn.CounterConn = bufio.NewCounterConn(conn, readCounter, writeCounter)
+	return limitedConn
+}
+
+func (l *RateLimiter[U]) wrapPacketConn(user U, conn N.PacketConn, upload bool, download bool) N.PacketConn {
+	if l == nil {
+		return conn
+	}
+	limitedConn := &rateLimitedPacketConn{done: make(chan struct{})}
+	var readCounter, writeCounter []N.CountFunc
+	if upload {
+		readCounter = []N.CountFunc{l.waitFunc(user, true, limitedConn.done)}
+	}
+	if download {
+		writeCounter = []N.CountFunc{l.waitFunc(user, false, limitedConn.done)}
+	}
+	limitedConn.CounterPacketConn = bufio.NewCounterPacketConn(conn, readCounter, writeCounter)
+	return limitedConn
+}
+
+// rateLimitedConn cancels pending waits when it is closed.
+type rateLimitedConn struct {
+	*bufio.CounterConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *rateLimitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.CounterConn.Close()
+}
+
+func (c *rateLimitedConn) Upstream() any {
+	return c.CounterConn
+}
+
+type rateLimitedPacketConn struct {
+	*bufio.CounterPacketConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *rateLimitedPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.CounterPacketConn.Close()
+}
+
+func (c *rateLimitedPacketConn) Upstream() any {
+	return c.CounterPacketConn
+}
+
+// tokenBucket allows a burst of one second of traffic. Transfers larger than
+// the available tokens are let through and paid back by delaying the caller.
+type tokenBucket struct {
+	access sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.rate = float64(rate)
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// wait delays the caller until n bytes are paid for, or done is closed.
+func (b *tokenBucket) wait(n int64, done <-chan struct{}) {
+	b.access.Lock()
+	if b.rate <= 0 || n <= 0 {
+		b.access.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.access.Unlock()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+		}
+	}
+}
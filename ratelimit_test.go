@@ -0,0 +1,79 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestRateLimiterUnlimitedUsers(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter[string]()
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := limiter.WrapConn("free", server)
+	defer conn.Close()
+	limiter.SetLimit("limited", 1024, 0)
+	limiter.SetLimit("limited", 0, 0)
+	if len(limiter.buckets) != 0 {
+		t.Fatal("created buckets for unlimited users: ", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterCloseCancelsWait(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter[string]()
+	limiter.SetLimit("test", 1, 1)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := limiter.WrapConn("test", server)
+	go client.Write(make([]byte, 1024))
+	done := make(chan struct{})
+	go func() {
+		_, _ = conn.Read(make([]byte, 1024))
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_ = conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close did not cancel the rate limit wait")
+	}
+}
+
+func TestRateLimiterMuxUpload(t *testing.T) {
+	t.Parallel()
+	const rate = 64 * 1024
+	limiter := NewRateLimiter[string]()
+	limiter.SetLimit("test", rate, rate)
+	service := newTestService(t, testEchoHandler{}, ServiceWithMuxPolicy(MuxPolicy{StreamBufferSize: rate * 3 / 2}))
+	service.SetRateLimiter(limiter)
+	address := startTestServer(t, service)
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The buffer holds the burst of one second, but not the whole upload.
+	payload := bytes.Repeat([]byte("limited"), 3*rate/7)
+	start := time.Now()
+	go conn.Write(payload)
+	response := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, payload) {
+		t.Fatal("bad echo")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatal("upload not limited, took ", elapsed)
+	}
+}
@@ -0,0 +1,157 @@
+package vmess
+
+import (
+	"errors"
+	"os"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// RejectStage is the step of request processing a connection was rejected at.
+type RejectStage uint8
+
+const (
+	// RejectStageAuthID is the VMess auth ID, or the VLESS UUID.
+	RejectStageAuthID RejectStage = iota + 1
+	// RejectStageLength is the encrypted length of the VMess AEAD header.
+	RejectStageLength
+	// RejectStageHeader is the request header, including the checks of the decoded request.
+	RejectStageHeader
+	// RejectStageBody is the request body, such as mux frames.
+	RejectStageBody
+)
+
+func (s RejectStage) String() string {
+	switch s {
+	case RejectStageAuthID:
+		return "auth id"
+	case RejectStageLength:
+		return "length"
+	case RejectStageHeader:
+		return "header"
+	case RejectStageBody:
+		return "body"
+	default:
+		return "unknown"
+	}
+}
+
+// RejectReason classifies why a connection was rejected.
+type RejectReason uint8
+
+const (
+	// RejectReasonConnection is a transport error or EOF, not caused by the content of the request.
+	RejectReasonConnection RejectReason = iota + 1
+	RejectReasonTimeout
+	RejectReasonBadHeader
+	RejectReasonUnknownUser
+	RejectReasonBadTimestamp
+	RejectReasonReplay
+	RejectReasonDecrypt
+	RejectReasonBadVersion
+	RejectReasonBadChecksum
+	RejectReasonBadSecurity
+	RejectReasonBadOption
+	RejectReasonBadCommand
+	RejectReasonBadAddress
+	RejectReasonBadFlow
+	RejectReasonBadFrame
+	RejectReasonInactiveCredential
+	RejectReasonExpired
+	RejectReasonQuota
+	RejectReasonPolicy
+	RejectReasonLimit
+	RejectReasonHook
+	RejectReasonBanned
+	// RejectReasonUserStore is a failure of the user store, not caused by the content of the request.
+	RejectReasonUserStore
+)
+
+var rejectReasonNames = map[RejectReason]string{
+	RejectReasonConnection:         "connection",
+	RejectReasonTimeout:            "timeout",
+	RejectReasonBadHeader:          "bad header",
+	RejectReasonUnknownUser:        "unknown user",
+	RejectReasonBadTimestamp:       "bad timestamp",
+	RejectReasonReplay:             "replay",
+	RejectReasonDecrypt:            "decrypt",
+	RejectReasonBadVersion:         "bad version",
+	RejectReasonBadChecksum:        "bad checksum",
+	RejectReasonBadSecurity:        "bad security",
+	RejectReasonBadOption:          "bad option",
+	RejectReasonBadCommand:         "bad command",
+	RejectReasonBadAddress:         "bad address",
+	RejectReasonBadFlow:            "bad flow",
+	RejectReasonBadFrame:           "bad frame",
+	RejectReasonInactiveCredential: "inactive credential",
+	RejectReasonExpired:            "expired",
+	RejectReasonQuota:              "quota",
+	RejectReasonPolicy:             "policy",
+	RejectReasonLimit:              "limit",
+	RejectReasonHook:               "hook",
+	RejectReasonBanned:             "banned",
+	RejectReasonUserStore:          "user store",
+}
+
+func (r RejectReason) String() string {
+	if name, loaded := rejectReasonNames[r]; loaded {
+		return name
+	}
+	return "unknown"
+}
+
+// RejectError is returned for every connection that is rejected before it is dispatched to the handler.
+// It wraps the cause, so errors.Is still matches sentinels such as ErrReplay.
+type RejectError struct {
+	Protocol string
+	Stage    RejectStage
+	Reason   RejectReason
+	// User is the authenticated user, nil if the request was rejected before authentication.
+	User   any
+	Source M.Socksaddr
+	Cause  error
+}
+
+func (e *RejectError) Error() string {
+	return E.Cause(e.Cause, e.Protocol, " rejected at ", e.Stage, " (", e.Reason, ") from ", e.Source).Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Cause
+}
+
+// causeReason classifies the errors shared by the services.
+func causeReason(cause error, fallback RejectReason) RejectReason {
+	switch {
+	case errors.Is(cause, ErrHandshakeTimeout), errors.Is(cause, os.ErrDeadlineExceeded):
+		return RejectReasonTimeout
+	case errors.Is(cause, ErrCredentialInactive):
+		return RejectReasonInactiveCredential
+	case errors.Is(cause, ErrUserExpired):
+		return RejectReasonExpired
+	case errors.Is(cause, ErrQuotaExceeded):
+		return RejectReasonQuota
+	case errors.Is(cause, ErrPolicyViolation):
+		return RejectReasonPolicy
+	case errors.Is(cause, ErrSourceBanned):
+		return RejectReasonBanned
+	case errors.Is(cause, ErrConnLimit), errors.Is(cause, ErrStreamLimit), errors.Is(cause, ErrSourceLimit),
+		errors.Is(cause, ErrMuxStreamLimit), errors.Is(cause, ErrMuxStreamRate):
+		return RejectReasonLimit
+	default:
+		return fallback
+	}
+}
+
+// NewRejectError creates a RejectError, reasons of the errors defined by this package override reason.
+func NewRejectError(protocol string, stage RejectStage, reason RejectReason, user any, source M.Socksaddr, cause error) *RejectError {
+	return &RejectError{
+		Protocol: protocol,
+		Stage:    stage,
+		Reason:   causeReason(cause, reason),
+		User:     user,
+		Source:   source,
+		Cause:    cause,
+	}
+}
@@ -0,0 +1,155 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestRejectErrorReason(t *testing.T) {
+	t.Parallel()
+	source := M.ParseSocksaddr("127.0.0.1:1000")
+	for _, testCase := range []struct {
+		cause  error
+		reason RejectReason
+	}{
+		{ErrHandshakeTimeout, RejectReasonTimeout},
+		{E.Cause(ErrConnLimit, "track"), RejectReasonLimit},
+		{ErrMuxStreamRate, RejectReasonLimit},
+		{ErrQuotaExceeded, RejectReasonQuota},
+		{ErrUserExpired, RejectReasonExpired},
+		{ErrSourceBanned, RejectReasonBanned},
+		{ErrReplay, RejectReasonBadHeader},
+	} {
+		err := NewRejectError("vmess", RejectStageHeader, RejectReasonBadHeader, nil, source, testCase.cause)
+		if err.Reason != testCase.reason {
+			t.Error(testCase.cause, ": reason ", err.Reason, ", expected ", testCase.reason)
+		}
+		if !errors.Is(err, testCase.cause) {
+			t.Error(testCase.cause, ": cause not wrapped")
+		}
+	}
+}
+
+// serveTestMuxConn returns a raw Mux.Cool connection to service, and the error its connection is closed with.
+func serveTestMuxConn(t *testing.T, service *Service[string]) (net.Conn, <-chan error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- service.NewConnection(context.Background(), server, M.ParseSocksaddr("127.0.0.1:1000"), nil)
+		_ = server.Close()
+	}()
+	vmessClient, err := NewClient(testUserID, "aes-128-gcm", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := vmessClient.DialMuxConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, done
+}
+
+func TestMuxBadFrame(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"short metadata length", []byte{0, 2, 0, 1}},
+		{"bad network", []byte{0, 5, 0, 1, StatusNew, 0, 9}},
+		{"short metadata", []byte{0, 5, 0, 1, StatusNew, 0, NetworkTCP}},
+		{"bad address", []byte{0, 8, 0, 1, StatusNew, 0, NetworkTCP, 0, 80, 9}},
+		{"bad status", []byte{0, 4, 0, 1, 9, 0}},
+	} {
+		conn, done := serveTestMuxConn(t, newTestService(t, testEchoHandler{}))
+		_, err := conn.Write(testCase.frame)
+		if err != nil {
+			t.Fatal(testCase.name, ": ", err)
+		}
+		select {
+		case err = <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal(testCase.name, ": connection not closed")
+		}
+		var rejectErr *RejectError
+		if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectReasonBadFrame || rejectErr.Stage != RejectStageBody {
+			t.Error(testCase.name, ": expected a bad frame, got ", err)
+		}
+	}
+}
+
+func TestMuxDuplicateSession(t *testing.T) {
+	t.Parallel()
+	service := newTestService(t, testEchoHandler{})
+	rejected := make(chan *RejectError, 1)
+	service.SetStreamRejectHandler(func(err *RejectError) {
+		rejected <- err
+	})
+	conn, _ := serveTestMuxConn(t, service)
+	newFrame := []byte{0, 12, 0, 1, StatusNew, 0, NetworkTCP, 0, 80, 1, 127, 0, 0, 1}
+	_, err := conn.Write(newFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		return service.conns.Count("test") == 2
+	}, "stream not tracked")
+	_, err = conn.Write(newFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-rejected:
+		if err.Reason != RejectReasonBadFrame {
+			t.Fatal("expected a bad frame, got ", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("duplicate session not rejected")
+	}
+	response := make([]byte, 6)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || string(response) != string([]byte{0, 4, 0, 1, StatusEnd, OptionError}) {
+		t.Fatal("expected an error end frame, got ", response, " ", err)
+	}
+	waitFor(t, func() bool {
+		return service.conns.Count("test") == 1
+	}, "streams of a duplicate session still tracked")
+
+	_, err = conn.Write([]byte{0, 12, 0, 1, StatusNew, OptionData, NetworkTCP, 0, 80, 1, 127, 0, 0, 1, 0, 4, 'p', 'i', 'n', 'g'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = make([]byte, 12)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || string(response) != string([]byte{0, 4, 0, 1, StatusKeep, OptionData, 0, 4, 'p', 'i', 'n', 'g'}) {
+		t.Fatal("reused session not echoed: ", response, " ", err)
+	}
+}
+
+func TestMuxTruncatedFrame(t *testing.T) {
+	t.Parallel()
+	conn, done := serveTestMuxConn(t, newTestService(t, testEchoHandler{}))
+	_, err := conn.Write([]byte{0, 12, 0, 1, StatusNew})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	err = <-done
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) && rejectErr.Reason == RejectReasonBadFrame {
+		t.Fatal("connection closed in a frame reported as a bad frame: ", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !E.IsClosed(err) {
+		t.Fatal("expected a transport error, got ", err)
+	}
+}
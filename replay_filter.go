@@ -0,0 +1,263 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/replay"
+)
+
+var _ replay.Filter = (*BloomReplayFilter)(nil)
+
+const (
+	DefaultReplayFilterCapacity          = 1 << 18
+	DefaultReplayFilterFalsePositiveRate = 1e-6
+	DefaultReplayFilterInterval          = 2 * CacheDurationSeconds * time.Second
+)
+
+var bloomReplayFilterMagic = [4]byte{'S', 'V', 'R', 'F'}
+
+const bloomReplayFilterVersion = 1
+
+type BloomReplayFilterOptions struct {
+	// Capacity is the expected number of handshakes per interval.
+	Capacity int
+	// FalsePositiveRate is the probability that a fresh handshake is rejected as a replay.
+	FalsePositiveRate float64
+	// Interval is the rotation interval. Every entry is remembered for at least
+	// one interval, so it must not be shorter than the accepted timestamp range.
+	Interval time.Duration
+	// Path is the file the filter state is loaded from and saved to, empty to disable persistence.
+	Path string
+	// TimeFunc defaults to time.Now.
+	TimeFunc TimeFunc
+}
+
+// BloomReplayFilter is a memory bounded replay filter made of two Bloom filters
+// rotated every interval. Its state can be saved to a file, so a restart does
+// not forget recent handshakes.
+type BloomReplayFilter struct {
+	access   sync.Mutex
+	salt     [16]byte
+	bitCount uint64
+	hashes   uint32
+	interval time.Duration
+	path     string
+	time     TimeFunc
+	lastSwap time.Time
+	current  []uint64
+	previous []uint64
+}
+
+func NewBloomReplayFilter(options BloomReplayFilterOptions) (*BloomReplayFilter, error) {
+	if options.Capacity <= 0 {
+		options.Capacity = DefaultReplayFilterCapacity
+	}
+	if options.FalsePositiveRate <= 0 || options.FalsePositiveRate >= 1 {
+		options.FalsePositiveRate = DefaultReplayFilterFalsePositiveRate
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultReplayFilterInterval
+	}
+	if options.TimeFunc == nil {
+		options.TimeFunc = time.Now
+	}
+	bitCount := uint64(math.Ceil(-float64(options.Capacity) * math.Log(options.FalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	bitCount = (bitCount + 63) / 64 * 64
+	hashes := uint32(math.Round(float64(bitCount) / float64(options.Capacity) * math.Ln2))
+	if hashes == 0 {
+		hashes = 1
+	}
+	filter := &BloomReplayFilter{
+		bitCount: bitCount,
+		hashes:   hashes,
+		interval: options.Interval,
+		path:     options.Path,
+		time:     options.TimeFunc,
+		lastSwap: options.TimeFunc(),
+		current:  make([]uint64, bitCount/64),
+		previous: make([]uint64, bitCount/64),
+	}
+	common.Must1(io.ReadFull(rand.Reader, filter.salt[:]))
+	if filter.path != "" {
+		err := filter.load()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, E.Cause(err, "load replay filter")
+		}
+	}
+	return filter, nil
+}
+
+func (f *BloomReplayFilter) Check(sum []byte) bool {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.rotate(f.time())
+	h1, h2 := f.hash(sum)
+	var seen bool
+	if f.contains(f.current, h1, h2) || f.contains(f.previous, h1, h2) {
+		seen = true
+	}
+	if !seen {
+		f.add(f.current, h1, h2)
+	}
+	return !seen
+}
+
+func (f *BloomReplayFilter) rotate(now time.Time) {
+	elapsed := now.Sub(f.lastSwap)
+	if elapsed < f.interval {
+		return
+	}
+	if elapsed >= 2*f.interval {
+		clear64(f.previous)
+	} else {
+		copy(f.previous, f.current)
+	}
+	clear64(f.current)
+	f.lastSwap = now
+}
+
+func (f *BloomReplayFilter) hash(sum []byte) (uint64, uint64) {
+	hash := sha256.New()
+	common.Must1(hash.Write(f.salt[:]))
+	common.Must1(hash.Write(sum))
+	var hashValue [sha256.Size]byte
+	hash.Sum(hashValue[:0])
+	return binary.BigEndian.Uint64(hashValue[:8]), binary.BigEndian.Uint64(hashValue[8:16]) | 1
+}
+
+func (f *BloomReplayFilter) contains(bits []uint64, h1 uint64, h2 uint64) bool {
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.bitCount
+		if bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomReplayFilter) add(bits []uint64, h1 uint64, h2 uint64) {
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.bitCount
+		bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func clear64(bits []uint64) {
+	for i := range bits {
+		bits[i] = 0
+	}
+}
+
+// Save writes the filter state to its file, it is a no-op if no path is configured.
+func (f *BloomReplayFilter) Save() error {
+	if f.path == "" {
+		return nil
+	}
+	f.access.Lock()
+	var content bytes.Buffer
+	content.Grow(4 + 1 + 16 + 8 + 8 + 4 + len(f.current)*16)
+	content.Write(bloomReplayFilterMagic[:])
+	content.WriteByte(bloomReplayFilterVersion)
+	content.Write(f.salt[:])
+	common.Must(
+		binary.Write(&content, binary.BigEndian, f.lastSwap.UnixNano()),
+		binary.Write(&content, binary.BigEndian, f.bitCount),
+		binary.Write(&content, binary.BigEndian, f.hashes),
+		binary.Write(&content, binary.BigEndian, f.current),
+		binary.Write(&content, binary.BigEndian, f.previous),
+	)
+	f.access.Unlock()
+	tempPath := f.path + ".tmp"
+	err := os.MkdirAll(filepath.Dir(f.path), 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(tempPath, content.Bytes(), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, f.path)
+}
+
+// Close saves the filter state.
+func (f *BloomReplayFilter) Close() error {
+	return f.Save()
+}
+
+func (f *BloomReplayFilter) load() error {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	reader := bytes.NewReader(content)
+	var magic [4]byte
+	_, err = io.ReadFull(reader, magic[:])
+	if err != nil {
+		return err
+	}
+	if magic != bloomReplayFilterMagic {
+		return E.New("bad magic")
+	}
+	version, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != bloomReplayFilterVersion {
+		return E.New("unknown version: ", version)
+	}
+	var (
+		salt     [16]byte
+		lastSwap int64
+		bitCount uint64
+		hashes   uint32
+	)
+	_, err = io.ReadFull(reader, salt[:])
+	if err != nil {
+		return err
+	}
+	err = binary.Read(reader, binary.BigEndian, &lastSwap)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(reader, binary.BigEndian, &bitCount)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(reader, binary.BigEndian, &hashes)
+	if err != nil {
+		return err
+	}
+	if bitCount != f.bitCount || hashes != f.hashes {
+		// sizing changed, the old state can not be reused
+		return nil
+	}
+	current := make([]uint64, bitCount/64)
+	previous := make([]uint64, bitCount/64)
+	err = binary.Read(reader, binary.BigEndian, current)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(reader, binary.BigEndian, previous)
+	if err != nil {
+		return err
+	}
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.salt = salt
+	f.lastSwap = time.Unix(0, lastSwap)
+	f.current = current
+	f.previous = previous
+	f.rotate(f.time())
+	return nil
+}
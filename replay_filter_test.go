@@ -0,0 +1,82 @@
+package vmess
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	access sync.Mutex
+	now    time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestBloomReplayFilterRotate(t *testing.T) {
+	t.Parallel()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	filter, err := NewBloomReplayFilter(BloomReplayFilterOptions{
+		Capacity: 1024,
+		Interval: time.Minute,
+		TimeFunc: clock.Now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Check([]byte("first")) {
+		t.Fatal("rejected a fresh sum")
+	}
+	if filter.Check([]byte("first")) {
+		t.Fatal("accepted a replayed sum")
+	}
+	clock.Add(time.Minute)
+	if filter.Check([]byte("first")) {
+		t.Fatal("forgot a sum after one rotation")
+	}
+	clock.Add(2 * time.Minute)
+	if !filter.Check([]byte("first")) {
+		t.Fatal("remembered a sum for more than two intervals")
+	}
+}
+
+func TestBloomReplayFilterPersist(t *testing.T) {
+	t.Parallel()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	options := BloomReplayFilterOptions{
+		Capacity: 1024,
+		Interval: time.Minute,
+		Path:     filepath.Join(t.TempDir(), "replay"),
+		TimeFunc: clock.Now,
+	}
+	filter, err := NewBloomReplayFilter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.Check([]byte("saved"))
+	err = filter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err = NewBloomReplayFilter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Check([]byte("saved")) {
+		t.Fatal("forgot a sum after a restart")
+	}
+	if !filter.Check([]byte("fresh")) {
+		t.Fatal("rejected a fresh sum after a restart")
+	}
+}
@@ -3,16 +3,13 @@ package vmess
 import (
 	"bytes"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/binary"
-	"hash/crc32"
+	"hash/fnv"
 	"io"
-	"math"
 	"net"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -24,9 +21,6 @@ import (
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/replay"
-	"github.com/sagernet/sing/common/rw"
-
-	"github.com/gofrs/uuid/v5"
 )
 
 type Handler interface {
@@ -40,84 +34,212 @@ var (
 	ErrReplay       = E.New("replayed request")
 	ErrBadRequest   = E.New("bad request")
 	ErrBadVersion   = E.New("bad version")
+
+	ErrBadChecksum     = E.New("bad header checksum")
+	ErrBadSecurityType = E.New("bad security type")
+	ErrBadOption       = E.New("bad option")
+	ErrBadCommand      = E.New("bad command")
+	ErrBadAddress      = E.New("bad address")
+
+	ErrCredentialInactive = E.New("credential not active")
 )
 
+const requestOptionMask = RequestOptionChunkStream | RequestOptionConnectionReuse | RequestOptionChunkMasking | RequestOptionGlobalPadding | RequestOptionAuthenticatedLength
+
 type Service[U comparable] struct {
-	userKey              map[U][16]byte
-	userIdCipher         map[U]cipher.Block
+	users                *MemoryUserStore[U]
+	store                UserStore[U]
+	conns                ConnTracker[U]
+	stats                StatsCounter[U]
+	requestHook          RequestHook[U]
+	rateLimiter          *RateLimiter[U]
+	quota                *QuotaManager[U]
+	probeGuard           *ProbeGuard
 	replayFilter         replay.Filter
 	handler              Handler
 	time                 func() time.Time
+	timeWindow           time.Duration
+	skewHandler          func(user U, skew time.Duration)
+	streamRejectHandler  func(err *RejectError)
 	disableHeaderProtect bool
-	alterIds             map[U][][16]byte
-	alterIdUpdateTime    map[U]int64
-	alterIdMap           map[[16]byte]legacyUserEntry[U]
+	fallbackHandler      FallbackHandler
+	drain                *DrainOptions
+	policy               *SecurityPolicy
+	policyAccess         sync.RWMutex
+	userPolicies         map[U]*SecurityPolicy
+	timeouts             TimeoutPolicy
+	userTimeouts         map[U]*TimeoutPolicy
+	muxPolicy            MuxPolicy
 	alterIdUpdateTask    *time.Ticker
 	alterIdUpdateDone    chan struct{}
 }
 
-type legacyUserEntry[U comparable] struct {
-	User  U
-	Time  int64
-	Index int
-}
-
 func NewService[U comparable](handler Handler, options ...ServiceOption) *Service[U] {
 	service := &Service[U]{
-		replayFilter: replay.NewSimple(time.Second * 120),
-		handler:      handler,
-		time:         time.Now,
+		handler:    handler,
+		time:       time.Now,
+		timeWindow: CacheDurationSeconds * time.Second,
 	}
 	anyService := (*Service[string])(unsafe.Pointer(service))
 	for _, option := range options {
 		option(anyService)
 	}
+	if service.replayFilter == nil {
+		service.replayFilter = replay.NewSimple(2 * service.timeWindow)
+	}
+	service.users = NewMemoryUserStore[U](service.time, service.timeWindow)
+	service.SetUserStore(service.users)
 	return service
 }
 
+// UpdateUsers replaces the users of the built-in store, like the other user methods of Service
+// it has no effect on requests if an external store is set.
 func (s *Service[U]) UpdateUsers(userList []U, userIdList []string, alterIdList []int) error {
-	userKeyMap := make(map[U][16]byte)
-	userIdCipherMap := make(map[U]cipher.Block)
-	userAlterIds := make(map[U][][16]byte)
-	for i, user := range userList {
-		userId := userIdList[i]
-		userUUID, err := uuid.FromString(userId)
-		if err != nil {
-			userUUID = uuid.NewV5(uuid.Nil, userId)
-		}
-		userCmdKey := Key(userUUID)
-		userKeyMap[user] = userCmdKey
-		userIdCipher, err := aes.NewCipher(KDF(userCmdKey[:], KDFSaltConstAuthIDEncryptionKey)[:16])
-		if err != nil {
-			return err
-		}
-		userIdCipherMap[user] = userIdCipher
-		alterId := alterIdList[i]
-		if alterId > 0 {
-			alterIds := make([][16]byte, 0, alterId)
-			currentId := userUUID
-			for j := 0; j < alterId; j++ {
-				currentId = AlterId(currentId)
-				alterIds = append(alterIds, currentId)
-			}
-			userAlterIds[user] = alterIds
-		}
+	return s.users.UpdateUsers(userList, userIdList, alterIdList)
+}
+
+// AddUser adds a single user without touching the key material of other users.
+func (s *Service[U]) AddUser(user U, userId string, alterId int) error {
+	return s.users.AddUser(user, userId, alterId)
+}
+
+// ReplaceUser updates the credentials of a user, or adds it if it does not exist.
+func (s *Service[U]) ReplaceUser(user U, userId string, alterId int) error {
+	return s.users.SetUserCredentials(user, []Credential{{UUID: userId, AlterId: alterId}})
+}
+
+// SetUserCredentials replaces the credentials of a user, or adds it if it does not exist.
+// All credentials authenticate as the same user, so a UUID can be rotated by adding the new one
+// before removing the old one. Connections of the user are not closed.
+func (s *Service[U]) SetUserCredentials(user U, credentials []Credential) error {
+	return s.users.SetUserCredentials(user, credentials)
+}
+
+func (s *Service[U]) RemoveUser(user U) {
+	s.users.RemoveUser(user)
+}
+
+// SetUserStore makes the service resolve users from store instead of the built-in store.
+// Live connections of users removed from the built-in store or a CachedUserStore are closed.
+func (s *Service[U]) SetUserStore(store UserStore[U]) {
+	s.store = store
+	if notifier, isNotifier := store.(userRemovalNotifier[U]); isNotifier {
+		notifier.setRemoved(func(user U) {
+			s.conns.CloseUser(user, ErrUserRemoved)
+		})
+	}
+}
+
+// SetStatsCounter sets the counter that receives per-user traffic and connection events.
+func (s *Service[U]) SetStatsCounter(counter StatsCounter[U]) {
+	s.stats = counter
+}
+
+// SetRequestHook sets the hook that can reject, rewrite or tag every request before it is dispatched.
+func (s *Service[U]) SetRequestHook(hook RequestHook[U]) {
+	s.requestHook = hook
+}
+
+// SetRateLimiter sets the limiter applied to the payload of every connection and mux stream.
+func (s *Service[U]) SetRateLimiter(limiter *RateLimiter[U]) {
+	s.rateLimiter = limiter
+}
+
+// SetQuotaManager sets the manager that enforces user expiration and traffic quotas.
+func (s *Service[U]) SetQuotaManager(manager *QuotaManager[U]) {
+	s.quota = manager
+	if manager != nil {
+		manager.AttachTracker(&s.conns)
 	}
-	s.userKey = userKeyMap
-	s.userIdCipher = userIdCipherMap
-	s.alterIds = userAlterIds
-	s.alterIdUpdateTime = make(map[U]int64)
-	s.generateLegacyKeys()
-	return nil
+}
+
+// SetProbeGuard sets the guard that bans sources sending invalid requests, banned sources
+// are rejected before authentication with the fallback or drain behavior of the service.
+func (s *Service[U]) SetProbeGuard(guard *ProbeGuard) {
+	s.probeGuard = guard
+}
+
+// SetClockSkewHandler sets a handler that receives the clock skew observed in every handshake of an identified user,
+// including handshakes rejected because the skew exceeds the time window.
+// A positive skew means the client clock is ahead.
+func (s *Service[U]) SetClockSkewHandler(handler func(user U, skew time.Duration)) {
+	s.skewHandler = handler
+}
+
+// SetStreamRejectHandler sets a handler that receives the RejectError of every mux stream rejected
+// by a limit, the security policy, the quota or the request hook. The mux connection stays open.
+func (s *Service[U]) SetStreamRejectHandler(handler func(err *RejectError)) {
+	s.streamRejectHandler = handler
+}
+
+// SetUserPolicy overrides the service security policy for user, a nil policy removes the override.
+func (s *Service[U]) SetUserPolicy(user U, policy *SecurityPolicy) {
+	s.policyAccess.Lock()
+	defer s.policyAccess.Unlock()
+	if policy == nil {
+		delete(s.userPolicies, user)
+		return
+	}
+	if s.userPolicies == nil {
+		s.userPolicies = make(map[U]*SecurityPolicy)
+	}
+	s.userPolicies[user] = policy
+}
+
+func (s *Service[U]) userPolicy(user U) *SecurityPolicy {
+	s.policyAccess.RLock()
+	defer s.policyAccess.RUnlock()
+	if policy, loaded := s.userPolicies[user]; loaded {
+		return policy
+	}
+	return s.policy
+}
+
+// SetConnLimit sets the connection limit of users without their own limit.
+func (s *Service[U]) SetConnLimit(limit ConnLimit) {
+	s.conns.SetDefaultLimit(limit)
+}
+
+// SetUserConnLimit overrides the connection limit of user, a nil limit removes the override.
+func (s *Service[U]) SetUserConnLimit(user U, limit *ConnLimit) {
+	s.conns.SetLimit(user, limit)
+}
+
+// SetUserTimeoutPolicy overrides the service timeout policy for user, a nil policy removes the override.
+// The handshake timeout always comes from the service policy, as the user is not known before the handshake.
+func (s *Service[U]) SetUserTimeoutPolicy(user U, policy *TimeoutPolicy) {
+	s.policyAccess.Lock()
+	defer s.policyAccess.Unlock()
+	if policy == nil {
+		delete(s.userTimeouts, user)
+		return
+	}
+	if s.userTimeouts == nil {
+		s.userTimeouts = make(map[U]*TimeoutPolicy)
+	}
+	s.userTimeouts[user] = policy
+}
+
+func (s *Service[U]) userTimeoutPolicy(user U) TimeoutPolicy {
+	s.policyAccess.RLock()
+	defer s.policyAccess.RUnlock()
+	if policy, loaded := s.userTimeouts[user]; loaded {
+		return *policy
+	}
+	return s.timeouts
+}
+
+// KickUser closes all live connections and mux streams of user with ErrUserKicked,
+// and returns the number of connections closed.
+func (s *Service[U]) KickUser(user U) int {
+	return s.conns.CloseUser(user, ErrUserKicked)
 }
 
 func (s *Service[U]) Start() error {
 	const updateInterval = 10 * time.Second
-	if len(s.alterIds) > 0 {
-		s.alterIdUpdateTask = time.NewTicker(updateInterval)
-		s.alterIdUpdateDone = make(chan struct{})
-		go s.loopGenerateLegacyKeys()
-	}
+	s.alterIdUpdateTask = time.NewTicker(updateInterval)
+	s.alterIdUpdateDone = make(chan struct{})
+	go s.loopGenerateLegacyKeys()
 	return nil
 }
 
@@ -136,108 +258,122 @@ func (s *Service[U]) loopGenerateLegacyKeys() {
 			return
 		case <-s.alterIdUpdateTask.C:
 		}
-		s.generateLegacyKeys()
-	}
-}
-
-func (s *Service[U]) generateLegacyKeys() {
-	nowSec := s.time().Unix()
-	endSec := nowSec + CacheDurationSeconds
-	var hashValue [16]byte
-
-	userAlterIdMap := make(map[[16]byte]legacyUserEntry[U])
-	userAlterIdUpdateTime := make(map[U]int64)
-
-	for user, alterIds := range s.alterIds {
-		beginSec := s.alterIdUpdateTime[user]
-		if beginSec < nowSec-CacheDurationSeconds {
-			beginSec = nowSec - CacheDurationSeconds
-		}
-		for i, alterId := range alterIds {
-			idHash := hmac.New(md5.New, alterId[:])
-			for ts := beginSec; ts <= endSec; ts++ {
-				common.Must(binary.Write(idHash, binary.BigEndian, uint64(ts)))
-				idHash.Sum(hashValue[:0])
-				idHash.Reset()
-				userAlterIdMap[hashValue] = legacyUserEntry[U]{user, ts, i}
-			}
+		if refresher, isRefresher := s.store.(legacyKeyRefresher); isRefresher {
+			refresher.refreshLegacyKeys()
 		}
-		userAlterIdUpdateTime[user] = nowSec
 	}
-	s.alterIdUpdateTime = userAlterIdUpdateTime
-	s.alterIdMap = userAlterIdMap
 }
 
 func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.Socksaddr, onClose N.CloseHandlerFunc) error {
 	const headerLenBufferLen = 2 + CipherOverhead
 	const aeadMinHeaderLen = 16 + headerLenBufferLen + 8 + CipherOverhead + 42
 	minHeaderLen := aeadMinHeaderLen
-	if len(s.alterIds) > 0 {
+	if s.store.HasLegacy() {
 		minHeaderLen = 16 + 38
 	}
 
+	var (
+		userKey UserKey[U]
+		found   bool
+	)
+	reject := func(stage RejectStage, reason RejectReason, cause error) error {
+		var user any
+		if found {
+			user = userKey.User
+		}
+		err := NewRejectError("vmess", stage, reason, user, source, cause)
+		s.probeGuard.Observe(err)
+		return err
+	}
+
+	trackedConn := NewTrackedConn(conn)
+	conn = trackedConn
+	trackedConn.startHandshakeTimer(s.timeouts.Handshake)
+	defer trackedConn.stopHandshakeTimer()
+
 	requestBuffer := buf.New()
 	defer requestBuffer.Release()
 
 	if !s.disableHeaderProtect {
 		n, err := requestBuffer.ReadOnceFrom(conn)
 		if err != nil {
-			return err
+			return reject(RejectStageAuthID, RejectReasonConnection, err)
 		}
 		if n < minHeaderLen {
-			return ErrBadHeader
+			return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonBadHeader, ErrBadHeader))
 		}
 	} else {
 		_, err := requestBuffer.ReadAtLeastFrom(conn, minHeaderLen)
 		if err != nil {
-			return err
+			return reject(RejectStageAuthID, RejectReasonConnection, err)
 		}
 	}
 
+	if s.probeGuard.Banned(source) {
+		return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonBanned, ErrSourceBanned))
+	}
+
 	authId := requestBuffer.To(16)
 	var decodedId [16]byte
-	var user U
-	var found bool
-	for currUser, userIdBlock := range s.userIdCipher {
-		userIdBlock.Decrypt(decodedId[:], authId)
-		timestamp := int64(binary.BigEndian.Uint64(decodedId[:]))
-		checksum := binary.BigEndian.Uint32(decodedId[12:])
-		if crc32.ChecksumIEEE(decodedId[:12]) != checksum {
-			continue
+	userKey, found, err := s.store.MatchAuthID(authId, &decodedId)
+	if err != nil {
+		return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonUserStore, err))
+	}
+	if found {
+		skew := time.Duration(int64(binary.BigEndian.Uint64(decodedId[:]))-s.time().Unix()) * time.Second
+		if s.skewHandler != nil {
+			s.skewHandler(userKey.User, skew)
 		}
-		if math.Abs(math.Abs(float64(timestamp))-float64(time.Now().Unix())) > 120 {
-			return ErrBadTimestamp
+		if skew > s.timeWindow || skew < -s.timeWindow {
+			return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonBadTimestamp, ErrBadTimestamp))
 		}
 		if !s.replayFilter.Check(decodedId[:]) {
-			return ErrReplay
+			return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonReplay, ErrReplay))
 		}
-		user = currUser
-		found = true
-		break
 	}
 
 	var legacyProtocol bool
 	var legacyTimestamp uint64
 	if !found {
 		copy(decodedId[:], authId)
-		if currUser, loaded := s.alterIdMap[decodedId]; loaded {
-			found = true
+		var timestamp int64
+		userKey, timestamp, found, err = s.store.MatchLegacyAuthID(decodedId)
+		if err != nil {
+			return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonUserStore, err))
+		}
+		if found {
 			legacyProtocol = true
-			user = currUser.User
-			legacyTimestamp = uint64(currUser.Time)
+			legacyTimestamp = uint64(timestamp)
+			if s.skewHandler != nil {
+				s.skewHandler(userKey.User, time.Duration(timestamp-s.time().Unix())*time.Second)
+			}
 		}
 	}
 	if !found {
-		return ErrBadRequest
+		return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonUnknownUser, ErrBadRequest))
+	}
+	if !userKey.Credential.Active(s.time()) {
+		return s.rejectConnection(ctx, trackedConn, requestBuffer, source, onClose, reject(RejectStageAuthID, RejectReasonInactiveCredential, ErrCredentialInactive))
 	}
 
+	user := userKey.User
+	err = s.quota.Check(user)
+	if err != nil {
+		return s.drainConnection(trackedConn, reject(RejectStageAuthID, RejectReasonQuota, err))
+	}
 	ctx = auth.ContextWithUser(ctx, user)
-	cmdKey := s.userKey[user]
+	policy := s.userPolicy(user)
+	if legacyProtocol {
+		err = policy.checkLegacy()
+		if err != nil {
+			return s.drainConnection(trackedConn, reject(RejectStageAuthID, RejectReasonPolicy, err))
+		}
+	}
+	cmdKey := userKey.CmdKey
 	var headerReader io.Reader
 	var headerBuffer []byte
 
 	var reader io.Reader
-	var err error
 	if legacyProtocol {
 		requestBuffer.Advance(16)
 		reader = io.MultiReader(bytes.NewReader(requestBuffer.Bytes()), conn)
@@ -247,16 +383,15 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
-		userKey := s.userKey[user]
-		headerReader = NewStreamReader(reader, userKey[:], timeHash.Sum(nil))
+		headerReader = NewStreamReader(reader, cmdKey[:], timeHash.Sum(nil))
 		headerBuffer = make([]byte, 38)
 		_, err = io.ReadFull(headerReader, headerBuffer)
 		if err != nil {
-			return E.Extend(ErrBadHeader, io.ErrShortBuffer)
+			return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadHeader, E.Extend(ErrBadHeader, io.ErrShortBuffer)))
 		}
 	} else {
 		if requestBuffer.Len() < aeadMinHeaderLen {
-			return ErrBadHeader
+			return s.drainConnection(trackedConn, reject(RejectStageLength, RejectReasonBadHeader, ErrBadHeader))
 		}
 
 		reader = conn
@@ -268,7 +403,7 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 		lengthNonce := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
 		lengthBuffer, err := newAesGcm(lengthKey).Open(requestBuffer.Index(16), lengthNonce, requestBuffer.Range(16, nonceIndex), authId)
 		if err != nil {
-			return err
+			return s.drainConnection(trackedConn, reject(RejectStageLength, RejectReasonDecrypt, err))
 		}
 
 		const headerIndex = nonceIndex + 8
@@ -277,7 +412,7 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 		if needRead > 0 {
 			_, err = requestBuffer.ReadFullFrom(conn, needRead)
 			if err != nil {
-				return err
+				return reject(RejectStageHeader, RejectReasonConnection, err)
 			}
 		}
 
@@ -285,11 +420,11 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 		headerNonce := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
 		headerBuffer, err = newAesGcm(headerKey).Open(requestBuffer.Index(headerIndex), headerNonce, requestBuffer.Range(headerIndex, headerIndex+headerLength+CipherOverhead), authId)
 		if err != nil {
-			return err
+			return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonDecrypt, err))
 		}
 		// replace with < if support mux
 		if len(headerBuffer) <= 38 {
-			return E.Extend(ErrBadHeader, io.ErrShortBuffer)
+			return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadHeader, E.Extend(ErrBadHeader, io.ErrShortBuffer)))
 		}
 		requestBuffer.Advance(headerIndex + headerLength + CipherOverhead)
 		headerReader = bytes.NewReader(headerBuffer[38:])
@@ -297,7 +432,7 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 
 	version := headerBuffer[0]
 	if version != Version {
-		return E.Extend(ErrBadVersion, version)
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadVersion, E.Extend(ErrBadVersion, version)))
 	}
 
 	requestBodyKey := make([]byte, 16)
@@ -311,31 +446,69 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 	paddingLen := int(headerBuffer[35] >> 4)
 	security := headerBuffer[35] & 0x0F
 	command := headerBuffer[37]
+	switch security {
+	case SecurityTypeLegacy, SecurityTypeAes128Gcm, SecurityTypeChacha20Poly1305, SecurityTypeNone:
+	default:
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadSecurity, E.Extend(ErrBadSecurityType, security)))
+	}
+	if option&^requestOptionMask != 0 {
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadOption, E.Extend(ErrBadOption, option)))
+	}
+	if headerBuffer[36] != 0 {
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadHeader, E.Extend(ErrBadHeader, "bad reserved byte")))
+	}
 	switch command {
 	case CommandTCP, CommandUDP, CommandMux:
 	default:
-		return E.New("unknown command: ", command)
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadCommand, E.Extend(ErrBadCommand, command)))
 	}
-	if command == CommandUDP && option == 0 {
-		return E.New("bad packet connection")
+	if command == CommandUDP && option&RequestOptionChunkStream == 0 {
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadOption, E.Extend(ErrBadOption, "bad packet connection")))
 	}
+	headerHash := fnv.New32a()
+	common.Must1(headerHash.Write(headerBuffer[:38]))
+	hashedReader := io.TeeReader(headerReader, headerHash)
 	var destination M.Socksaddr
 	if command != CommandMux {
-		destination, err = AddressSerializer.ReadAddrPort(headerReader)
+		destination, err = AddressSerializer.ReadAddrPort(hashedReader)
 		if err != nil {
-			return err
+			return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadAddress, E.Extend(ErrBadAddress, err)))
 		}
 	}
 	if paddingLen > 0 {
-		_, err = io.CopyN(io.Discard, headerReader, int64(paddingLen))
+		_, err = io.CopyN(io.Discard, hashedReader, int64(paddingLen))
 		if err != nil {
-			return E.Extend(ErrBadHeader, "bad padding")
+			return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadHeader, E.Extend(ErrBadHeader, "bad padding")))
 		}
 	}
-	err = rw.SkipN(headerReader, 4)
+	var checksum [4]byte
+	_, err = io.ReadFull(headerReader, checksum[:])
 	if err != nil {
-		return err
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadHeader, E.Extend(ErrBadHeader, "missing checksum")))
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != headerHash.Sum32() {
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadChecksum, ErrBadChecksum))
+	}
+	if headerBytesReader, isBytesReader := headerReader.(*bytes.Reader); isBytesReader && headerBytesReader.Len() > 0 {
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonBadHeader, E.Extend(ErrBadHeader, "trailing header data")))
 	}
+
+	err = policy.checkRequest(security, option, command)
+	if err != nil {
+		return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonPolicy, err))
+	}
+
+	if legacyProtocol {
+		// the legacy auth hash only changes every second, so replays are detected
+		// by the random request nonce and key it is sent with.
+		var replayKey [16 + 32]byte
+		copy(replayKey[:16], decodedId[:])
+		copy(replayKey[16:], headerBuffer[1:33])
+		if !s.replayFilter.Check(replayKey[:]) {
+			return s.drainConnection(trackedConn, reject(RejectStageHeader, RejectReasonReplay, ErrReplay))
+		}
+	}
+
 	if !legacyProtocol && requestBuffer.Len() > 0 {
 		reader = bufio.NewCachedReader(reader, requestBuffer.ToOwned())
 	}
@@ -354,19 +527,113 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, source M.
 		reader:         bufio.NewExtendedReader(reader),
 	}
 
+	metadata := ConnMetadata{
+		Protocol:    "vmess",
+		Command:     command,
+		Security:    security,
+		Legacy:      legacyProtocol,
+		Source:      source,
+		Destination: destination,
+	}
+	if command != CommandMux {
+		ctx, destination, err = s.requestHook.Route(ctx, user, metadata)
+		if err != nil {
+			return reject(RejectStageHeader, RejectReasonHook, err)
+		}
+		metadata.Destination = destination
+	}
+	if !trackedConn.stopHandshakeTimer() {
+		return reject(RejectStageHeader, RejectReasonTimeout, ErrHandshakeTimeout)
+	}
+	if command == CommandMux {
+		s.rateLimiter.LimitMuxConn(user, trackedConn)
+	}
+	timeouts := s.userTimeoutPolicy(user)
+	trackedConn.startIdleTimer(timeouts)
+	connStats := NewConnStats(s.stats, user, metadata)
+	trackedConn.SetStats(connStats)
+	err = s.conns.TrackConn(user, trackedConn, source)
+	if err != nil {
+		trackedConn.Close()
+		return reject(RejectStageHeader, RejectReasonLimit, err)
+	}
+	rawConn.tracked = trackedConn
 	switch command {
 	case CommandTCP:
-		s.handler.NewConnectionEx(ctx, &serverConn{rawConn}, source, destination, onClose)
+		s.handler.NewConnectionEx(ctx, s.wrapConn(user, connStats.WrapConn(&serverConn{rawConn})), source, destination, onClose)
 	case CommandUDP:
-		s.handler.NewPacketConnectionEx(ctx, &serverPacketConn{rawConn, destination}, source, destination, onClose)
+		s.handler.NewPacketConnectionEx(ctx, s.wrapPacketConn(user, connStats.WrapPacketConn(&serverPacketConn{rawConn, destination})), source, destination, onClose)
 	case CommandMux:
-		return HandleMuxConnection(ctx, &serverConn{rawConn}, source, s.handler)
-	default:
-		return E.New("unknown command: ", command)
+		defer trackedConn.Close()
+		return HandleMuxConnectionEx(ctx, &serverConn{rawConn}, source, s.handler, MuxServerOptions{
+			TrackStream: func(closer func(err error)) (func(), error) {
+				return s.conns.TrackStream(user, closer)
+			},
+			RouteStream: func(ctx context.Context, command byte, destination M.Socksaddr) (context.Context, M.Socksaddr, error) {
+				err := policy.checkCommand(command)
+				if err != nil {
+					return nil, M.Socksaddr{}, err
+				}
+				err = s.quota.Check(user)
+				if err != nil {
+					return nil, M.Socksaddr{}, err
+				}
+				return s.requestHook.Route(ctx, user, metadata.ForMuxStream(command, destination))
+			},
+			RejectStream: func(err *RejectError) {
+				if s.streamRejectHandler != nil {
+					err.User = user
+					s.streamRejectHandler(err)
+				}
+			},
+			IdleTimeout: timeouts.ConnIdle,
+			MuxPolicy:   s.muxPolicy,
+			StreamStats: func(command byte, destination M.Socksaddr) *ConnStats {
+				return NewConnStats(s.stats, user, metadata.ForMuxStream(command, destination))
+			},
+			WrapConn: func(conn net.Conn) net.Conn {
+				return s.quota.WrapConn(user, s.rateLimiter.WrapMuxStream(user, conn))
+			},
+			WrapPacketConn: func(conn N.PacketConn) N.PacketConn {
+				return s.quota.WrapPacketConn(user, s.rateLimiter.WrapMuxPacketStream(user, conn))
+			},
+		})
 	}
 	return nil
 }
 
+func (s *Service[U]) wrapConn(user U, conn net.Conn) net.Conn {
+	return s.quota.WrapConn(user, s.rateLimiter.WrapConn(user, conn))
+}
+
+func (s *Service[U]) wrapPacketConn(user U, conn N.PacketConn) N.PacketConn {
+	return s.quota.WrapPacketConn(user, s.rateLimiter.WrapPacketConn(user, conn))
+}
+
+// rejectConnection handles a connection that failed authentication,
+// requestBuffer must still hold every byte read from conn.
+func (s *Service[U]) rejectConnection(ctx context.Context, conn *TrackedConn, requestBuffer *buf.Buffer, source M.Socksaddr, onClose N.CloseHandlerFunc, cause error) error {
+	if s.fallbackHandler == nil {
+		return s.drainConnection(conn, cause)
+	}
+	if !conn.stopHandshakeTimer() {
+		if rejectErr, isReject := cause.(*RejectError); isReject {
+			return NewRejectError(rejectErr.Protocol, rejectErr.Stage, RejectReasonTimeout, rejectErr.User, source, ErrHandshakeTimeout)
+		}
+		return ErrHandshakeTimeout
+	}
+	s.fallbackHandler.NewFallbackConnectionEx(ctx, bufio.NewCachedConn(conn, requestBuffer.ToOwned()), source, onClose)
+	return nil
+}
+
+// drainConnection handles a connection with an invalid request, it returns cause after draining the connection if enabled.
+func (s *Service[U]) drainConnection(conn *TrackedConn, cause error) error {
+	if s.drain != nil {
+		s.drain.drain(conn, conn.pendingBytes())
+	}
+	return cause
+}
+
 type rawServerConn struct {
 	net.Conn
 	legacyProtocol bool
@@ -377,6 +644,7 @@ type rawServerConn struct {
 	option         byte
 	reader         N.ExtendedReader
 	writer         N.ExtendedWriter
+	tracked        *TrackedConn
 }
 
 func (c *rawServerConn) writeResponse() error {
@@ -459,7 +727,11 @@ type serverConn struct {
 }
 
 func (c *serverConn) Read(b []byte) (n int, err error) {
-	return c.reader.Read(b)
+	n, err = c.reader.Read(b)
+	if err == io.EOF {
+		c.tracked.uplinkClosed()
+	}
+	return
 }
 
 func (c *serverConn) Write(b []byte) (n int, err error) {
@@ -473,7 +745,11 @@ func (c *serverConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *serverConn) ReadBuffer(buffer *buf.Buffer) error {
-	return c.reader.ReadBuffer(buffer)
+	err := c.reader.ReadBuffer(buffer)
+	if err == io.EOF {
+		c.tracked.uplinkClosed()
+	}
+	return err
 }
 
 func (c *serverConn) WriteBuffer(buffer *buf.Buffer) error {
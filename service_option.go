@@ -1,5 +1,11 @@
 package vmess
 
+import (
+	"time"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
 type ServiceOption func(service *Service[string])
 
 func ServiceWithTimeFunc(timeFunc TimeFunc) ServiceOption {
@@ -8,8 +14,62 @@ func ServiceWithTimeFunc(timeFunc TimeFunc) ServiceOption {
 	}
 }
 
+// ServiceWithTimeWindow sets the maximum accepted difference between the client and server clocks,
+// for both AEAD and legacy handshakes. The default is 120 seconds.
+func ServiceWithTimeWindow(window time.Duration) ServiceOption {
+	return func(service *Service[string]) {
+		service.timeWindow = window
+	}
+}
+
 func ServiceWithDisableHeaderProtection() ServiceOption {
 	return func(service *Service[string]) {
 		service.disableHeaderProtect = true
 	}
 }
+
+// ServiceWithReplayFilter replaces the default in-memory replay filter.
+// The same filter can be shared by multiple services to reject handshakes replayed across them.
+func ServiceWithReplayFilter(filter replay.Filter) ServiceOption {
+	return func(service *Service[string]) {
+		service.replayFilter = filter
+	}
+}
+
+// ServiceWithFallback hands connections that fail authentication to handler instead of returning an error,
+// so probers see the behavior of the fallback service instead of a closed connection.
+func ServiceWithFallback(handler FallbackHandler) ServiceOption {
+	return func(service *Service[string]) {
+		service.fallbackHandler = handler
+	}
+}
+
+// ServiceWithDrain makes the service drain rejected connections before returning the error.
+// Zero fields of options are set to the v2ray-core defaults.
+func ServiceWithDrain(options DrainOptions) ServiceOption {
+	return func(service *Service[string]) {
+		options.normalize()
+		service.drain = &options
+	}
+}
+
+// ServiceWithSecurityPolicy sets the security policy of users without their own policy.
+func ServiceWithSecurityPolicy(policy SecurityPolicy) ServiceOption {
+	return func(service *Service[string]) {
+		service.policy = &policy
+	}
+}
+
+// ServiceWithTimeoutPolicy sets the timeout policy of users without their own policy, and the handshake timeout.
+func ServiceWithTimeoutPolicy(policy TimeoutPolicy) ServiceOption {
+	return func(service *Service[string]) {
+		service.timeouts = policy
+	}
+}
+
+// ServiceWithMuxPolicy sets the policy of mux sessions.
+func ServiceWithMuxPolicy(policy MuxPolicy) ServiceOption {
+	return func(service *Service[string]) {
+		service.muxPolicy = policy
+	}
+}
@@ -0,0 +1,147 @@
+package vmess
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// StatsCounter receives per-user traffic and connection events.
+//
+// Payload bytes are the application data exchanged with the handler, wire bytes
+// are what is read from and written to the transport, including the handshake,
+// chunk framing, padding and authentication overhead. Wire bytes of a mux
+// connection are reported once on the carrier connection, and payload bytes
+// once per stream, so neither is counted twice.
+type StatsCounter[U comparable] interface {
+	ConnectionOpened(user U, metadata ConnMetadata)
+	ConnectionClosed(user U, metadata ConnMetadata, traffic Traffic)
+	AddTraffic(user U, traffic Traffic)
+}
+
+type ConnMetadata struct {
+	Protocol    string
+	Command     byte
+	Security    byte
+	Legacy      bool
+	Flow        string
+	MuxStream   bool
+	Source      M.Socksaddr
+	Destination M.Socksaddr
+}
+
+// ForMuxStream returns the metadata of a mux stream carried by the connection.
+func (m ConnMetadata) ForMuxStream(command byte, destination M.Socksaddr) ConnMetadata {
+	m.Command = command
+	m.MuxStream = true
+	m.Destination = destination
+	return m
+}
+
+type Traffic struct {
+	UploadPayload   int64
+	UploadWire      int64
+	DownloadPayload int64
+	DownloadWire    int64
+}
+
+// ConnStats accumulates the traffic of one connection or mux stream.
+// A nil *ConnStats discards everything.
+type ConnStats struct {
+	uploadPayload   int64
+	uploadWire      int64
+	downloadPayload int64
+	downloadWire    int64
+	add             func(traffic Traffic)
+	close           func(traffic Traffic)
+	closeOnce       sync.Once
+}
+
+func NewConnStats[U comparable](counter StatsCounter[U], user U, metadata ConnMetadata) *ConnStats {
+	if counter == nil {
+		return nil
+	}
+	counter.ConnectionOpened(user, metadata)
+	return &ConnStats{
+		add: func(traffic Traffic) {
+			counter.AddTraffic(user, traffic)
+		},
+		close: func(traffic Traffic) {
+			counter.ConnectionClosed(user, metadata, traffic)
+		},
+	}
+}
+
+func (s *ConnStats) AddUploadPayload(n int64) {
+	if s == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&s.uploadPayload, n)
+	s.add(Traffic{UploadPayload: n})
+}
+
+func (s *ConnStats) AddUploadWire(n int64) {
+	if s == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&s.uploadWire, n)
+	s.add(Traffic{UploadWire: n})
+}
+
+func (s *ConnStats) AddDownloadPayload(n int64) {
+	if s == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&s.downloadPayload, n)
+	s.add(Traffic{DownloadPayload: n})
+}
+
+func (s *ConnStats) AddDownloadWire(n int64) {
+	if s == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&s.downloadWire, n)
+	s.add(Traffic{DownloadWire: n})
+}
+
+func (s *ConnStats) Traffic() Traffic {
+	if s == nil {
+		return Traffic{}
+	}
+	return Traffic{
+		UploadPayload:   atomic.LoadInt64(&s.uploadPayload),
+		UploadWire:      atomic.LoadInt64(&s.uploadWire),
+		DownloadPayload: atomic.LoadInt64(&s.downloadPayload),
+		DownloadWire:    atomic.LoadInt64(&s.downloadWire),
+	}
+}
+
+// Close reports the connection as closed, it is safe to call multiple times.
+func (s *ConnStats) Close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		s.close(s.Traffic())
+	})
+}
+
+// WrapConn counts the payload of conn, it returns conn unchanged if s is nil.
+func (s *ConnStats) WrapConn(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return bufio.NewCounterConn(conn, []N.CountFunc{s.AddUploadPayload}, []N.CountFunc{s.AddDownloadPayload})
+}
+
+// WrapPacketConn counts the payload of conn, it returns conn unchanged if s is nil.
+func (s *ConnStats) WrapPacketConn(conn N.PacketConn) N.PacketConn {
+	if s == nil {
+		return conn
+	}
+	return bufio.NewCounterPacketConn(conn, []N.CountFunc{s.AddUploadPayload}, []N.CountFunc{s.AddDownloadPayload})
+}
@@ -0,0 +1,100 @@
+package vmess
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type testStatsCounter struct {
+	opened atomic.Int64
+	closed atomic.Int64
+	upload atomic.Int64
+}
+
+func (c *testStatsCounter) ConnectionOpened(user string, metadata ConnMetadata) {
+	c.opened.Add(1)
+}
+
+func (c *testStatsCounter) ConnectionClosed(user string, metadata ConnMetadata, traffic Traffic) {
+	c.closed.Add(1)
+}
+
+func (c *testStatsCounter) AddTraffic(user string, traffic Traffic) {
+	c.upload.Add(traffic.UploadPayload)
+}
+
+func newTestService(t *testing.T, handler Handler, options ...ServiceOption) *Service[string] {
+	service := NewService[string](handler, options...)
+	err := service.UpdateUsers([]string{"test"}, []string{testUserID}, []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func dialTestConn(t *testing.T, address string) net.Conn {
+	client, err := NewClient(testUserID, "aes-128-gcm", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitFor(t *testing.T, condition func() bool, message string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatsClosedWhileKicked(t *testing.T) {
+	t.Parallel()
+	counter := &testStatsCounter{}
+	service := newTestService(t, testEchoHandler{})
+	service.SetStatsCounter(counter)
+	address := startTestServer(t, service)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				service.KickUser("test")
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := dialTestConn(t, address)
+			defer conn.Close()
+			_, _ = conn.Write([]byte("ping"))
+			_, _ = io.ReadFull(conn, make([]byte, 4))
+		}()
+	}
+	wg.Wait()
+	close(done)
+	waitFor(t, func() bool {
+		return counter.opened.Load() == counter.closed.Load() && service.conns.Count("test") == 0
+	}, "connections left open")
+}
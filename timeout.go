@@ -0,0 +1,106 @@
+package vmess
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var (
+	ErrHandshakeTimeout = E.New("handshake timeout")
+	ErrIdleTimeout      = E.New("connection idle timeout")
+)
+
+// TimeoutPolicy is the v2ray style timeout policy of connections, zero fields are disabled.
+type TimeoutPolicy struct {
+	// Handshake limits the time to receive the request header.
+	Handshake time.Duration
+	// ConnIdle closes connections and mux streams without traffic in either direction.
+	ConnIdle time.Duration
+	// UplinkOnly replaces ConnIdle once the server has closed the downlink.
+	UplinkOnly time.Duration
+	// DownlinkOnly replaces ConnIdle once the client has closed the uplink.
+	DownlinkOnly time.Duration
+}
+
+// DefaultTimeoutPolicy is the default policy of v2ray.
+var DefaultTimeoutPolicy = TimeoutPolicy{
+	Handshake:    4 * time.Second,
+	ConnIdle:     300 * time.Second,
+	UplinkOnly:   2 * time.Second,
+	DownlinkOnly: 5 * time.Second,
+}
+
+// activityTimer calls onTimeout once there has been no activity for the timeout.
+type activityTimer struct {
+	access       sync.Mutex
+	timeout      time.Duration
+	lastActivity int64
+	timer        *time.Timer
+	onTimeout    func()
+}
+
+func newActivityTimer(timeout time.Duration, onTimeout func()) *activityTimer {
+	t := &activityTimer{
+		timeout:      timeout,
+		lastActivity: time.Now().UnixNano(),
+		onTimeout:    onTimeout,
+	}
+	t.access.Lock()
+	t.timer = time.AfterFunc(timeout, t.check)
+	t.access.Unlock()
+	return t
+}
+
+func (t *activityTimer) update() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+// setTimeout replaces the timeout, counting from now. A zero timeout keeps the current one.
+func (t *activityTimer) setTimeout(timeout time.Duration) {
+	if t == nil || timeout <= 0 {
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.timer == nil {
+		return
+	}
+	t.timeout = timeout
+	t.update()
+	t.timer.Reset(timeout)
+}
+
+func (t *activityTimer) check() {
+	t.access.Lock()
+	if t.timer == nil {
+		t.access.Unlock()
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		t.access.Unlock()
+		return
+	}
+	t.timer = nil
+	t.access.Unlock()
+	t.onTimeout()
+}
+
+func (t *activityTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,76 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	service := newTestService(t, testEchoHandler{}, ServiceWithTimeoutPolicy(TimeoutPolicy{Handshake: 100 * time.Millisecond}))
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.NewConnection(context.Background(), server, M.ParseSocksaddr("127.0.0.1:1000"), nil)
+	}()
+	select {
+	case err := <-done:
+		var rejectErr *RejectError
+		if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectReasonTimeout || !errors.Is(err, ErrHandshakeTimeout) {
+			t.Fatal("expected a handshake timeout, got ", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent connection not closed")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	t.Parallel()
+	service := newTestService(t, testEchoHandler{}, ServiceWithTimeoutPolicy(TimeoutPolicy{ConnIdle: 200 * time.Millisecond}))
+	address := startTestServer(t, service)
+	conn := dialTestConn(t, address)
+	defer conn.Close()
+	for i := 0; i < 8; i++ {
+		testMuxEcho(t, conn)
+		time.Sleep(50 * time.Millisecond)
+	}
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("idle connection not closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("idle connection closed after ", elapsed)
+	}
+}
+
+func TestMuxStreamIdleTimeout(t *testing.T) {
+	t.Parallel()
+	address := startTestMuxServer(t, testEchoHandler{}, ServiceWithMuxPolicy(MuxPolicy{StreamIdleTimeout: 200 * time.Millisecond}))
+	client, _ := newTestMuxClient(t, address, MuxClientOptions{})
+	conn, err := client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("idle stream not closed")
+	}
+	conn, err = client.DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	if client.Connections() != 1 {
+		t.Fatal("idle stream closed the session")
+	}
+}
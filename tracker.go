@@ -0,0 +1,387 @@
+package vmess
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var (
+	ErrUserRemoved = E.New("user removed")
+	ErrUserKicked  = E.New("user kicked")
+	ErrConnLimit   = E.New("too many connections")
+	ErrStreamLimit = E.New("too many mux streams")
+	ErrSourceLimit = E.New("too many source addresses")
+	ErrEvicted     = E.New("evicted by a newer connection")
+)
+
+type LimitPolicy uint8
+
+const (
+	// LimitPolicyRejectNewest rejects new connections over the limit.
+	LimitPolicyRejectNewest LimitPolicy = iota
+	// LimitPolicyEvictOldest closes the oldest connections with ErrEvicted to make room for new ones.
+	LimitPolicyEvictOldest
+)
+
+// ConnLimit limits the live connections of a user, zero fields are unlimited.
+type ConnLimit struct {
+	// MaxConns limits the transport connections, mux streams are not counted.
+	MaxConns int
+	// MaxStreams limits the mux streams over all connections.
+	MaxStreams int
+	// MaxSources limits the distinct source addresses of the transport connections.
+	MaxSources int
+	Policy     LimitPolicy
+}
+
+// ConnTracker tracks the live connections and mux streams of each authenticated user,
+// so they can be closed when the user is removed or kicked, and limited.
+type ConnTracker[U comparable] struct {
+	access       sync.Mutex
+	conns        map[U]map[*trackedItem]struct{}
+	defaultLimit ConnLimit
+	limits       map[U]ConnLimit
+	sequence     uint64
+}
+
+type trackedItem struct {
+	closer   func(err error)
+	stream   bool
+	source   netip.Addr
+	sequence uint64
+}
+
+// SetDefaultLimit sets the limit of users without their own limit.
+func (t *ConnTracker[U]) SetDefaultLimit(limit ConnLimit) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.defaultLimit = limit
+}
+
+// SetLimit overrides the default limit for user, a nil limit removes the override.
+// Connections that are already established are not affected.
+func (t *ConnTracker[U]) SetLimit(user U, limit *ConnLimit) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if limit == nil {
+		delete(t.limits, user)
+		return
+	}
+	if t.limits == nil {
+		t.limits = make(map[U]ConnLimit)
+	}
+	t.limits[user] = *limit
+}
+
+// TrackConn registers conn as a transport connection of user from source, it is untracked on close.
+// conn can be closed as soon as it is added, so its stats and timers must be set before,
+// and the cause is returned if it was closed before TrackConn returned.
+func (t *ConnTracker[U]) TrackConn(user U, conn *TrackedConn, source M.Socksaddr) error {
+	item := &trackedItem{closer: conn.CloseWithError, source: source.Addr}
+	conn.untrack = t.untrackFunc(user, item)
+	err := t.add(user, item)
+	if err != nil {
+		conn.untrack = nil
+		return err
+	}
+	return conn.closeCause()
+}
+
+// TrackStream registers a mux stream of user. closer is called with the cause when the stream is kicked or evicted,
+// and the returned function must be called once the stream is closed.
+func (t *ConnTracker[U]) TrackStream(user U, closer func(err error)) (untrack func(), err error) {
+	item := &trackedItem{closer: closer, stream: true}
+	err = t.add(user, item)
+	if err != nil {
+		return nil, err
+	}
+	return t.untrackFunc(user, item), nil
+}
+
+func (t *ConnTracker[U]) add(user U, item *trackedItem) error {
+	t.access.Lock()
+	if t.conns == nil {
+		t.conns = make(map[U]map[*trackedItem]struct{})
+	}
+	userConns := t.conns[user]
+	if userConns == nil {
+		userConns = make(map[*trackedItem]struct{})
+		t.conns[user] = userConns
+	}
+	limit, loaded := t.limits[user]
+	if !loaded {
+		limit = t.defaultLimit
+	}
+	evicted, err := admitItem(userConns, item, limit)
+	if err != nil {
+		if len(userConns) == 0 {
+			delete(t.conns, user)
+		}
+		t.access.Unlock()
+		return err
+	}
+	t.sequence++
+	item.sequence = t.sequence
+	userConns[item] = struct{}{}
+	t.access.Unlock()
+	for _, evictedItem := range evicted {
+		evictedItem.closer(ErrEvicted)
+	}
+	return nil
+}
+
+func (t *ConnTracker[U]) untrackFunc(user U, item *trackedItem) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.access.Lock()
+			defer t.access.Unlock()
+			userConns := t.conns[user]
+			delete(userConns, item)
+			if len(userConns) == 0 {
+				delete(t.conns, user)
+			}
+		})
+	}
+}
+
+// admitItem checks item against limit, and removes the items that have to be evicted for it from userConns.
+func admitItem(userConns map[*trackedItem]struct{}, item *trackedItem, limit ConnLimit) ([]*trackedItem, error) {
+	var evicted []*trackedItem
+	for {
+		victims, err := checkLimit(userConns, item, limit)
+		if err == nil {
+			return evicted, nil
+		}
+		if limit.Policy != LimitPolicyEvictOldest || len(victims) == 0 {
+			for _, evictedItem := range evicted {
+				userConns[evictedItem] = struct{}{}
+			}
+			return nil, err
+		}
+		for _, victim := range victims {
+			delete(userConns, victim)
+		}
+		evicted = append(evicted, victims...)
+	}
+}
+
+// checkLimit returns the error of the first limit item exceeds, with the items to evict for it:
+// the oldest stream or connection, or all connections of the oldest source.
+func checkLimit(userConns map[*trackedItem]struct{}, item *trackedItem, limit ConnLimit) ([]*trackedItem, error) {
+	if item.stream {
+		if limit.MaxStreams <= 0 {
+			return nil, nil
+		}
+		var streams int
+		var oldest *trackedItem
+		for other := range userConns {
+			if other.stream {
+				streams++
+				if oldest == nil || other.sequence < oldest.sequence {
+					oldest = other
+				}
+			}
+		}
+		if streams >= limit.MaxStreams {
+			return []*trackedItem{oldest}, ErrStreamLimit
+		}
+		return nil, nil
+	}
+	if limit.MaxConns > 0 {
+		var conns int
+		var oldest *trackedItem
+		for other := range userConns {
+			if !other.stream {
+				conns++
+				if oldest == nil || other.sequence < oldest.sequence {
+					oldest = other
+				}
+			}
+		}
+		if conns >= limit.MaxConns {
+			return []*trackedItem{oldest}, ErrConnLimit
+		}
+	}
+	if limit.MaxSources > 0 {
+		sources := make(map[netip.Addr]struct{})
+		var oldest *trackedItem
+		for other := range userConns {
+			if other.stream {
+				continue
+			}
+			if other.source == item.source {
+				return nil, nil
+			}
+			sources[other.source] = struct{}{}
+			if oldest == nil || other.sequence < oldest.sequence {
+				oldest = other
+			}
+		}
+		if len(sources) >= limit.MaxSources {
+			var victims []*trackedItem
+			for other := range userConns {
+				if !other.stream && other.source == oldest.source {
+					victims = append(victims, other)
+				}
+			}
+			return victims, ErrSourceLimit
+		}
+	}
+	return nil, nil
+}
+
+// Count returns the number of live connections and streams of user.
+func (t *ConnTracker[U]) Count(user U) int {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return len(t.conns[user])
+}
+
+// CloseUser closes all connections of user with err and returns the number closed.
+func (t *ConnTracker[U]) CloseUser(user U, err error) int {
+	t.access.Lock()
+	userConns := t.conns[user]
+	delete(t.conns, user)
+	t.access.Unlock()
+	for item := range userConns {
+		item.closer(err)
+	}
+	return len(userConns)
+}
+
+// TrackedConn is a connection that can be closed with a cause,
+// reads and writes after that fail with the cause instead of a generic closed error.
+type TrackedConn struct {
+	net.Conn
+	untrack        func()
+	closeErr       atomic.Pointer[error]
+	stats          *ConnStats
+	pendingRead    int64
+	handshakeTimer atomic.Pointer[time.Timer]
+	idleTimer      *activityTimer
+	idlePolicy     TimeoutPolicy
+}
+
+func NewTrackedConn(conn net.Conn) *TrackedConn {
+	return &TrackedConn{Conn: conn}
+}
+
+// SetStats starts counting wire traffic to stats,
+// bytes read before it is called, such as the handshake, are counted as well.
+func (c *TrackedConn) SetStats(stats *ConnStats) {
+	if stats == nil {
+		return
+	}
+	stats.AddUploadWire(c.pendingRead)
+	c.pendingRead = 0
+	c.stats = stats
+}
+
+func (c *TrackedConn) startHandshakeTimer(timeout time.Duration) {
+	if timeout > 0 {
+		c.handshakeTimer.Store(time.AfterFunc(timeout, func() {
+			c.CloseWithError(ErrHandshakeTimeout)
+		}))
+	}
+}
+
+// stopHandshakeTimer returns false if the handshake has already timed out.
+// It may be called concurrently with Close.
+func (c *TrackedConn) stopHandshakeTimer() bool {
+	timer := c.handshakeTimer.Load()
+	return timer == nil || timer.Stop()
+}
+
+// startIdleTimer closes the connection with ErrIdleTimeout once it is idle for longer than the policy allows.
+func (c *TrackedConn) startIdleTimer(policy TimeoutPolicy) {
+	if policy.ConnIdle <= 0 {
+		return
+	}
+	c.idlePolicy = policy
+	c.idleTimer = newActivityTimer(policy.ConnIdle, func() {
+		c.CloseWithError(ErrIdleTimeout)
+	})
+}
+
+func (c *TrackedConn) uplinkClosed() {
+	if c != nil {
+		c.idleTimer.setTimeout(c.idlePolicy.DownlinkOnly)
+	}
+}
+
+// pendingBytes returns the number of bytes read before SetStats was called.
+func (c *TrackedConn) pendingBytes() int64 {
+	return c.pendingRead
+}
+
+func (c *TrackedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.idleTimer.update()
+	if c.stats != nil {
+		c.stats.AddUploadWire(int64(n))
+	} else {
+		c.pendingRead += int64(n)
+	}
+	if err != nil {
+		err = c.cause(err)
+	}
+	return
+}
+
+func (c *TrackedConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.idleTimer.update()
+	c.stats.AddDownloadWire(int64(n))
+	if err != nil {
+		err = c.cause(err)
+	}
+	return
+}
+
+func (c *TrackedConn) cause(err error) error {
+	if closeErr := c.closeCause(); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+func (c *TrackedConn) closeCause() error {
+	if closeErr := c.closeErr.Load(); closeErr != nil {
+		return *closeErr
+	}
+	return nil
+}
+
+// CloseWithError closes the connection, reads and writes will return err from now on.
+func (c *TrackedConn) CloseWithError(err error) {
+	c.closeErr.Store(&err)
+	_ = c.Close()
+}
+
+// CloseWrite closes the downlink and switches the idle timeout to the uplink only timeout.
+func (c *TrackedConn) CloseWrite() error {
+	c.idleTimer.setTimeout(c.idlePolicy.UplinkOnly)
+	return N.CloseWrite(c.Conn)
+}
+
+func (c *TrackedConn) Close() error {
+	c.stopHandshakeTimer()
+	c.idleTimer.stop()
+	if c.untrack != nil {
+		c.untrack()
+	}
+	c.stats.Close()
+	return c.Conn.Close()
+}
+
+func (c *TrackedConn) Upstream() any {
+	return c.Conn
+}
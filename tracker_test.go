@@ -0,0 +1,180 @@
+package vmess
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func newTestTrackedConn(t *testing.T) *TrackedConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return NewTrackedConn(server)
+}
+
+func TestConnTrackerCloseUser(t *testing.T) {
+	t.Parallel()
+	var tracker ConnTracker[string]
+	conns := []*TrackedConn{newTestTrackedConn(t), newTestTrackedConn(t)}
+	for _, conn := range conns {
+		err := tracker.TrackConn("a", conn, M.ParseSocksaddr("127.0.0.1:1000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var streamErr error
+	_, err := tracker.TrackStream("a", func(err error) {
+		streamErr = err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestTrackedConn(t)
+	err = tracker.TrackConn("b", other, M.ParseSocksaddr("127.0.0.1:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed := tracker.CloseUser("a", ErrUserKicked); closed != 3 {
+		t.Fatal("closed ", closed, " connections, expected 3")
+	}
+	for _, conn := range conns {
+		_, err = conn.Read(make([]byte, 1))
+		if !errors.Is(err, ErrUserKicked) {
+			t.Fatal("read of a kicked connection returned ", err)
+		}
+	}
+	if !errors.Is(streamErr, ErrUserKicked) {
+		t.Fatal("stream closed with ", streamErr)
+	}
+	if tracker.Count("a") != 0 || tracker.Count("b") != 1 {
+		t.Fatal("bad counts after kick: ", tracker.Count("a"), " ", tracker.Count("b"))
+	}
+	_ = other.Close()
+	if tracker.Count("b") != 0 {
+		t.Fatal("closed connection still tracked")
+	}
+}
+
+func TestServiceKickUser(t *testing.T) {
+	t.Parallel()
+	service := newTestService(t, testEchoHandler{})
+	address := startTestServer(t, service)
+	conn := dialTestConn(t, address)
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	if kicked := service.KickUser("test"); kicked != 1 {
+		t.Fatal("kicked ", kicked, " connections, expected 1")
+	}
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("kicked connection still open")
+	}
+	conn = dialTestConn(t, address)
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	service.RemoveUser("test")
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection of a removed user still open")
+	}
+}
+
+func TestConnTrackerRejectNewest(t *testing.T) {
+	t.Parallel()
+	var tracker ConnTracker[string]
+	tracker.SetDefaultLimit(ConnLimit{MaxConns: 2, MaxStreams: 1})
+	source := M.ParseSocksaddr("127.0.0.1:1000")
+	for i := 0; i < 2; i++ {
+		err := tracker.TrackConn("a", newTestTrackedConn(t), source)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tracker.TrackConn("a", newTestTrackedConn(t), source)
+	if !errors.Is(err, ErrConnLimit) {
+		t.Fatal("expected connection limit, got ", err)
+	}
+	untrack, err := tracker.TrackStream("a", func(err error) {})
+	if err != nil {
+		t.Fatal("streams counted as connections: ", err)
+	}
+	_, err = tracker.TrackStream("a", func(err error) {})
+	if !errors.Is(err, ErrStreamLimit) {
+		t.Fatal("expected stream limit, got ", err)
+	}
+	untrack()
+	_, err = tracker.TrackStream("a", func(err error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.SetLimit("b", &ConnLimit{})
+	for i := 0; i < 3; i++ {
+		err = tracker.TrackConn("b", newTestTrackedConn(t), source)
+		if err != nil {
+			t.Fatal("user limit not applied: ", err)
+		}
+	}
+}
+
+func TestConnTrackerEvictOldest(t *testing.T) {
+	t.Parallel()
+	var tracker ConnTracker[string]
+	tracker.SetDefaultLimit(ConnLimit{MaxConns: 2, Policy: LimitPolicyEvictOldest})
+	source := M.ParseSocksaddr("127.0.0.1:1000")
+	var conns []*TrackedConn
+	for i := 0; i < 3; i++ {
+		conn := newTestTrackedConn(t)
+		err := tracker.TrackConn("a", conn, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	_, err := conns[0].Read(make([]byte, 1))
+	if !errors.Is(err, ErrEvicted) {
+		t.Fatal("oldest connection not evicted: ", err)
+	}
+	if tracker.Count("a") != 2 {
+		t.Fatal("bad count after eviction: ", tracker.Count("a"))
+	}
+}
+
+func TestConnTrackerSourceLimit(t *testing.T) {
+	t.Parallel()
+	var tracker ConnTracker[string]
+	tracker.SetDefaultLimit(ConnLimit{MaxSources: 1})
+	first := M.ParseSocksaddr("10.0.0.1:1000")
+	second := M.ParseSocksaddr("10.0.0.2:1000")
+	var conns []*TrackedConn
+	for i := 0; i < 2; i++ {
+		conn := newTestTrackedConn(t)
+		err := tracker.TrackConn("a", conn, first)
+		if err != nil {
+			t.Fatal("connection from a known source rejected: ", err)
+		}
+		conns = append(conns, conn)
+	}
+	err := tracker.TrackConn("a", newTestTrackedConn(t), second)
+	if !errors.Is(err, ErrSourceLimit) {
+		t.Fatal("expected source limit, got ", err)
+	}
+	tracker.SetDefaultLimit(ConnLimit{MaxSources: 1, Policy: LimitPolicyEvictOldest})
+	err = tracker.TrackConn("a", newTestTrackedConn(t), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range conns {
+		_, err = conn.Read(make([]byte, 1))
+		if !errors.Is(err, ErrEvicted) {
+			t.Fatal("connection of the oldest source not evicted: ", err)
+		}
+	}
+	if tracker.Count("a") != 1 {
+		t.Fatal("bad count after eviction: ", tracker.Count("a"))
+	}
+}
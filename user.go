@@ -0,0 +1,250 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// Credential is one of the UUIDs a user can authenticate with.
+type Credential struct {
+	UUID string
+	// AlterId enables the legacy protocol for the credential, it is ignored by VLESS.
+	AlterId int
+	// NotBefore and NotAfter limit the time the credential is accepted, zero values are unbounded.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Active reports whether the credential is accepted at now.
+func (c Credential) Active(now time.Time) bool {
+	return (c.NotBefore.IsZero() || !now.Before(c.NotBefore)) && (c.NotAfter.IsZero() || !now.After(c.NotAfter))
+}
+
+func (c Credential) equals(other Credential) bool {
+	return c.UUID == other.UUID && c.AlterId == other.AlterId && c.NotBefore.Equal(other.NotBefore) && c.NotAfter.Equal(other.NotAfter)
+}
+
+type userEntry[U comparable] struct {
+	user       U
+	credential Credential
+	cmdKey     [16]byte
+	idCipher   cipher.Block
+	alterIds   [][16]byte
+}
+
+func newUserEntry[U comparable](user U, credential Credential) (*userEntry[U], error) {
+	userUUID, err := uuid.FromString(credential.UUID)
+	if err != nil {
+		userUUID = uuid.NewV5(uuid.Nil, credential.UUID)
+	}
+	cmdKey := Key(userUUID)
+	idCipher, err := NewAuthIDCipher(cmdKey)
+	if err != nil {
+		return nil, err
+	}
+	entry := &userEntry[U]{
+		user:       user,
+		credential: credential,
+		cmdKey:     cmdKey,
+		idCipher:   idCipher,
+	}
+	if credential.AlterId > 0 {
+		entry.alterIds = make([][16]byte, 0, credential.AlterId)
+		currentId := userUUID
+		for j := 0; j < credential.AlterId; j++ {
+			currentId = AlterId(currentId)
+			entry.alterIds = append(entry.alterIds, currentId)
+		}
+	}
+	return entry, nil
+}
+
+func (e *userEntry[U]) key() UserKey[U] {
+	return UserKey[U]{
+		User:       e.user,
+		Credential: e.credential,
+		CmdKey:     e.cmdKey,
+	}
+}
+
+// userTable is an immutable snapshot of the configured users.
+// Writers build a new table and publish it atomically, readers never lock.
+// A user has one entry for each of its credentials.
+type userTable[U comparable] struct {
+	entries     []*userEntry[U]
+	index       map[U][]*userEntry[U]
+	matcher     *AuthIDMatcher
+	legacyUsers int
+}
+
+func newUserTable[U comparable](entries []*userEntry[U]) *userTable[U] {
+	table := &userTable[U]{
+		entries: entries,
+		index:   make(map[U][]*userEntry[U], len(entries)),
+		matcher: &AuthIDMatcher{make([]cipher.Block, 0, len(entries))},
+	}
+	for _, entry := range entries {
+		table.index[entry.user] = append(table.index[entry.user], entry)
+		table.matcher.blocks = append(table.matcher.blocks, entry.idCipher)
+		if len(entry.alterIds) > 0 {
+			table.legacyUsers++
+		}
+	}
+	return table
+}
+
+func (t *userTable[U]) lookup(user U) []*userEntry[U] {
+	if t == nil {
+		return nil
+	}
+	return t.index[user]
+}
+
+func (t *userTable[U]) contains(user U) bool {
+	return len(t.lookup(user)) > 0
+}
+
+// loadOrCreate returns the entry of user with credential, reusing the existing one
+// so that unchanged credentials keep their key material.
+func (t *userTable[U]) loadOrCreate(user U, credential Credential) (*userEntry[U], error) {
+	for _, entry := range t.lookup(user) {
+		if entry.credential.equals(credential) {
+			return entry, nil
+		}
+	}
+	return newUserEntry(user, credential)
+}
+
+// without returns the entries of all users except user.
+func (t *userTable[U]) without(user U) []*userEntry[U] {
+	if t == nil {
+		return nil
+	}
+	entries := make([]*userEntry[U], 0, len(t.entries))
+	for _, entry := range t.entries {
+		if entry.user != user {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+type legacyUserEntry[U comparable] struct {
+	Entry *userEntry[U]
+	Time  int64
+	Index int
+}
+
+type legacyTimeRange struct {
+	begin int64
+	end   int64
+}
+
+// legacyKeyTable maps legacy (alterId) auth hashes to users.
+// Every user entry owns a contiguous range of timestamps, so adding, removing
+// and sliding the window only touches the hashes of the affected entry.
+type legacyKeyTable[U comparable] struct {
+	access  sync.RWMutex
+	window  int64
+	keyMap  map[[16]byte]legacyUserEntry[U]
+	timeMap map[*userEntry[U]]legacyTimeRange
+}
+
+func (t *legacyKeyTable[U]) lookup(authId [16]byte) (legacyUserEntry[U], bool) {
+	t.access.RLock()
+	defer t.access.RUnlock()
+	entry, loaded := t.keyMap[authId]
+	return entry, loaded
+}
+
+func (t *legacyKeyTable[U]) add(entry *userEntry[U], nowSec int64) {
+	if len(entry.alterIds) == 0 {
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.keyMap == nil {
+		t.keyMap = make(map[[16]byte]legacyUserEntry[U])
+		t.timeMap = make(map[*userEntry[U]]legacyTimeRange)
+	}
+	timeRange := legacyTimeRange{nowSec - t.window, nowSec + t.window}
+	t.fill(entry, timeRange.begin, timeRange.end)
+	t.timeMap[entry] = timeRange
+}
+
+func (t *legacyKeyTable[U]) remove(entry *userEntry[U]) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	timeRange, loaded := t.timeMap[entry]
+	if !loaded {
+		return
+	}
+	t.clear(entry, timeRange.begin, timeRange.end)
+	delete(t.timeMap, entry)
+}
+
+func (t *legacyKeyTable[U]) refresh(nowSec int64) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	beginSec := nowSec - t.window
+	endSec := nowSec + t.window
+	for entry, timeRange := range t.timeMap {
+		if timeRange.end < beginSec || timeRange.begin > endSec {
+			// the clock jumped past the whole window
+			t.clear(entry, timeRange.begin, timeRange.end)
+			t.fill(entry, beginSec, endSec)
+			t.timeMap[entry] = legacyTimeRange{beginSec, endSec}
+			continue
+		}
+		if timeRange.begin < beginSec {
+			t.clear(entry, timeRange.begin, beginSec-1)
+		} else if timeRange.begin > beginSec {
+			t.fill(entry, beginSec, timeRange.begin-1)
+		}
+		if timeRange.end < endSec {
+			t.fill(entry, timeRange.end+1, endSec)
+		} else if timeRange.end > endSec {
+			t.clear(entry, endSec+1, timeRange.end)
+		}
+		t.timeMap[entry] = legacyTimeRange{beginSec, endSec}
+	}
+}
+
+func (t *legacyKeyTable[U]) fill(entry *userEntry[U], beginSec int64, endSec int64) {
+	var hashValue [16]byte
+	for i, alterId := range entry.alterIds {
+		idHash := hmac.New(md5.New, alterId[:])
+		for ts := beginSec; ts <= endSec; ts++ {
+			legacyAuthID(idHash, ts, &hashValue)
+			t.keyMap[hashValue] = legacyUserEntry[U]{entry, ts, i}
+		}
+	}
+}
+
+func (t *legacyKeyTable[U]) clear(entry *userEntry[U], beginSec int64, endSec int64) {
+	var hashValue [16]byte
+	for _, alterId := range entry.alterIds {
+		idHash := hmac.New(md5.New, alterId[:])
+		for ts := beginSec; ts <= endSec; ts++ {
+			legacyAuthID(idHash, ts, &hashValue)
+			if current, loaded := t.keyMap[hashValue]; loaded && current.Entry == entry {
+				delete(t.keyMap, hashValue)
+			}
+		}
+	}
+}
+
+func legacyAuthID(idHash hash.Hash, timestamp int64, hashValue *[16]byte) {
+	common.Must(binary.Write(idHash, binary.BigEndian, uint64(timestamp)))
+	idHash.Sum(hashValue[:0])
+	idHash.Reset()
+}
@@ -0,0 +1,367 @@
+package vmess
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// ErrUserStore wraps the errors of stores that fail to match a credential.
+var ErrUserStore = E.New("user store failure")
+
+// UserStore resolves the credentials of VMess requests.
+//
+// AEAD auth IDs are encrypted with the key of each credential, so they can not be
+// indexed and every store has to keep the key material of all credentials in memory.
+// Users and credentials can still be loaded and changed individually.
+type UserStore[U comparable] interface {
+	// MatchAuthID returns the credential whose command key decrypts authId to a valid AEAD auth ID,
+	// decodedId receives the decrypted auth ID. Errors are reported as store failures, not as unknown users.
+	MatchAuthID(authId []byte, decodedId *[16]byte) (UserKey[U], bool, error)
+	// MatchLegacyAuthID returns the legacy credential of a legacy auth hash, and the timestamp it was generated for.
+	MatchLegacyAuthID(authId [16]byte) (UserKey[U], int64, bool, error)
+	// HasLegacy reports whether any credential uses the legacy protocol.
+	HasLegacy() bool
+}
+
+// UserKey is a credential matched by a UserStore.
+type UserKey[U comparable] struct {
+	User       U
+	Credential Credential
+	CmdKey     [16]byte
+}
+
+type legacyKeyRefresher interface {
+	refreshLegacyKeys()
+}
+
+// userRemovalNotifier is implemented by stores that can report removed users to the service.
+type userRemovalNotifier[U comparable] interface {
+	setRemoved(removed func(user U))
+}
+
+var _ UserStore[string] = (*MemoryUserStore[string])(nil)
+
+// MemoryUserStore keeps all users in memory, it is the default store of Service.
+type MemoryUserStore[U comparable] struct {
+	users      atomic.Pointer[userTable[U]]
+	userAccess sync.Mutex
+	legacyKeys legacyKeyTable[U]
+	time       TimeFunc
+	removed    func(user U)
+}
+
+// NewMemoryUserStore creates an empty store, legacy auth hashes are accepted within timeWindow of the current time.
+func NewMemoryUserStore[U comparable](timeFunc TimeFunc, timeWindow time.Duration) *MemoryUserStore[U] {
+	if timeFunc == nil {
+		timeFunc = time.Now
+	}
+	store := &MemoryUserStore[U]{
+		time: timeFunc,
+	}
+	store.legacyKeys.window = int64(timeWindow / time.Second)
+	return store
+}
+
+func (s *MemoryUserStore[U]) UpdateUsers(userList []U, userIdList []string, alterIdList []int) error {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	oldTable := s.users.Load()
+	entries := make([]*userEntry[U], 0, len(userList))
+	for i, user := range userList {
+		entry, err := oldTable.loadOrCreate(user, Credential{UUID: userIdList[i], AlterId: alterIdList[i]})
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	s.storeUsers(oldTable, entries)
+	return nil
+}
+
+// AddUser adds a single user without touching the key material of other users.
+func (s *MemoryUserStore[U]) AddUser(user U, userId string, alterId int) error {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	oldTable := s.users.Load()
+	if oldTable.contains(user) {
+		return E.New("user already exists: ", user)
+	}
+	entry, err := newUserEntry(user, Credential{UUID: userId, AlterId: alterId})
+	if err != nil {
+		return err
+	}
+	s.storeUsers(oldTable, append(oldTable.without(user), entry))
+	return nil
+}
+
+// SetUserCredentials replaces the credentials of a user, or adds it if it does not exist.
+// Setting no credentials removes the user.
+func (s *MemoryUserStore[U]) SetUserCredentials(user U, credentials []Credential) error {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	oldTable := s.users.Load()
+	entries := oldTable.without(user)
+	for _, credential := range credentials {
+		entry, err := oldTable.loadOrCreate(user, credential)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	s.storeUsers(oldTable, entries)
+	return nil
+}
+
+func (s *MemoryUserStore[U]) RemoveUser(user U) {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	oldTable := s.users.Load()
+	if !oldTable.contains(user) {
+		return
+	}
+	s.storeUsers(oldTable, oldTable.without(user))
+}
+
+// storeUsers publishes a table of entries, updates the legacy keys of changed entries
+// and reports removed users. It must be called with userAccess held.
+func (s *MemoryUserStore[U]) storeUsers(oldTable *userTable[U], entries []*userEntry[U]) {
+	newTable := newUserTable(entries)
+	s.users.Store(newTable)
+	newEntries := make(map[*userEntry[U]]bool, len(entries))
+	for _, entry := range entries {
+		newEntries[entry] = true
+	}
+	oldEntries := make(map[*userEntry[U]]bool)
+	if oldTable != nil {
+		for _, entry := range oldTable.entries {
+			oldEntries[entry] = true
+			if !newEntries[entry] {
+				s.legacyKeys.remove(entry)
+			}
+		}
+		if s.removed != nil {
+			for user := range oldTable.index {
+				if !newTable.contains(user) {
+					s.removed(user)
+				}
+			}
+		}
+	}
+	nowSec := s.time().Unix()
+	for _, entry := range entries {
+		if !oldEntries[entry] {
+			s.legacyKeys.add(entry, nowSec)
+		}
+	}
+}
+
+func (s *MemoryUserStore[U]) MatchAuthID(authId []byte, decodedId *[16]byte) (UserKey[U], bool, error) {
+	users := s.users.Load()
+	if users == nil || users.matcher.Len() == 0 {
+		return UserKey[U]{}, false, nil
+	}
+	index, found := users.matcher.Match(authId, decodedId)
+	if !found {
+		return UserKey[U]{}, false, nil
+	}
+	return users.entries[index].key(), true, nil
+}
+
+func (s *MemoryUserStore[U]) MatchLegacyAuthID(authId [16]byte) (UserKey[U], int64, bool, error) {
+	legacyEntry, loaded := s.legacyKeys.lookup(authId)
+	if !loaded {
+		return UserKey[U]{}, 0, false, nil
+	}
+	return legacyEntry.Entry.key(), legacyEntry.Time, true, nil
+}
+
+func (s *MemoryUserStore[U]) HasLegacy() bool {
+	users := s.users.Load()
+	return users != nil && users.legacyUsers > 0
+}
+
+func (s *MemoryUserStore[U]) refreshLegacyKeys() {
+	s.legacyKeys.refresh(s.time().Unix())
+}
+
+func (s *MemoryUserStore[U]) setRemoved(removed func(user U)) {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	s.removed = removed
+}
+
+// UserSource loads users for a CachedUserStore, usually from a database.
+type UserSource[U comparable] interface {
+	// LoadUsers returns all users and their credentials.
+	LoadUsers(ctx context.Context) (map[U][]Credential, error)
+	// LoadUser returns the credentials of user, none if the user does not exist.
+	LoadUser(ctx context.Context, user U) ([]Credential, error)
+}
+
+const DefaultUserStoreRetryInterval = 5 * time.Second
+
+type CachedUserStoreOptions struct {
+	// RefreshInterval is the interval the whole source is reloaded at, zero to only load it once.
+	RefreshInterval time.Duration
+	// RetryInterval is the minimum interval between retries of a failed first load, the default is 5 seconds.
+	RetryInterval time.Duration
+	// TimeWindow is the accepted clock difference of legacy handshakes, the default is 120 seconds.
+	TimeWindow time.Duration
+	// TimeFunc defaults to time.Now.
+	TimeFunc TimeFunc
+}
+
+var _ UserStore[string] = (*CachedUserStore[string])(nil)
+
+// CachedUserStore keeps the users of a UserSource in memory. The source is loaded in the background
+// on first use, retried at most every retry interval until that succeeds, and reloaded every refresh interval.
+// Handshakes are never blocked by a load, they are rejected as store failures until the first load
+// succeeded, use Load to wait for it. Single users are reloaded with Invalidate.
+// Live connections of users that are no longer in the source are closed.
+type CachedUserStore[U comparable] struct {
+	source      UserSource[U]
+	options     CachedUserStoreOptions
+	cache       *MemoryUserStore[U]
+	loadAccess  sync.Mutex
+	loadAttempt atomic.Int64
+	loadTime    atomic.Int64
+	loadErr     atomic.Pointer[error]
+	reloading   atomic.Bool
+}
+
+func NewCachedUserStore[U comparable](source UserSource[U], options CachedUserStoreOptions) *CachedUserStore[U] {
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultUserStoreRetryInterval
+	}
+	if options.TimeWindow <= 0 {
+		options.TimeWindow = CacheDurationSeconds * time.Second
+	}
+	if options.TimeFunc == nil {
+		options.TimeFunc = time.Now
+	}
+	return &CachedUserStore[U]{
+		source:  source,
+		options: options,
+		cache:   NewMemoryUserStore[U](options.TimeFunc, options.TimeWindow),
+	}
+}
+
+// Load loads the source if it has not been loaded successfully yet.
+func (s *CachedUserStore[U]) Load(ctx context.Context) error {
+	s.loadAccess.Lock()
+	defer s.loadAccess.Unlock()
+	return s.load(ctx)
+}
+
+func (s *CachedUserStore[U]) load(ctx context.Context) error {
+	if s.loadTime.Load() != 0 {
+		return nil
+	}
+	s.loadAttempt.Store(s.options.TimeFunc().UnixNano())
+	err := s.Reload(ctx)
+	if err != nil {
+		s.loadErr.Store(&err)
+	}
+	return err
+}
+
+// Reload loads all users from the source and replaces the cached users.
+func (s *CachedUserStore[U]) Reload(ctx context.Context) error {
+	users, err := s.source.LoadUsers(ctx)
+	if err != nil {
+		return E.Cause(err, "load users")
+	}
+	s.cache.userAccess.Lock()
+	defer s.cache.userAccess.Unlock()
+	oldTable := s.cache.users.Load()
+	var entries []*userEntry[U]
+	for user, credentials := range users {
+		for _, credential := range credentials {
+			entry, err := oldTable.loadOrCreate(user, credential)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	s.cache.storeUsers(oldTable, entries)
+	s.loadTime.Store(s.options.TimeFunc().UnixNano())
+	return nil
+}
+
+// Invalidate reloads the credentials of user from the source.
+func (s *CachedUserStore[U]) Invalidate(ctx context.Context, user U) error {
+	credentials, err := s.source.LoadUser(ctx, user)
+	if err != nil {
+		return E.Cause(err, "load user ", user)
+	}
+	return s.cache.SetUserCredentials(user, credentials)
+}
+
+// ensureLoaded starts a background load if the first load is due for a retry, or a reload is due.
+// It returns a store failure until the first load succeeded.
+func (s *CachedUserStore[U]) ensureLoaded() error {
+	now := s.options.TimeFunc()
+	loadTime := s.loadTime.Load()
+	if loadTime == 0 {
+		if now.Sub(time.Unix(0, s.loadAttempt.Load())) >= s.options.RetryInterval {
+			s.startLoad()
+		}
+		if loadErr := s.loadErr.Load(); loadErr != nil {
+			return E.Cause1(ErrUserStore, *loadErr)
+		}
+		return E.Extend(ErrUserStore, "users not loaded")
+	}
+	if s.options.RefreshInterval > 0 && now.Sub(time.Unix(0, loadTime)) >= s.options.RefreshInterval {
+		s.startLoad()
+	}
+	return nil
+}
+
+func (s *CachedUserStore[U]) startLoad() {
+	if s.reloading.CompareAndSwap(false, true) {
+		go func() {
+			defer s.reloading.Store(false)
+			s.loadAccess.Lock()
+			defer s.loadAccess.Unlock()
+			if s.loadTime.Load() == 0 {
+				_ = s.load(context.Background())
+			} else {
+				_ = s.Reload(context.Background())
+			}
+		}()
+	}
+}
+
+func (s *CachedUserStore[U]) MatchAuthID(authId []byte, decodedId *[16]byte) (UserKey[U], bool, error) {
+	err := s.ensureLoaded()
+	if err != nil {
+		return UserKey[U]{}, false, err
+	}
+	return s.cache.MatchAuthID(authId, decodedId)
+}
+
+func (s *CachedUserStore[U]) MatchLegacyAuthID(authId [16]byte) (UserKey[U], int64, bool, error) {
+	err := s.ensureLoaded()
+	if err != nil {
+		return UserKey[U]{}, 0, false, err
+	}
+	return s.cache.MatchLegacyAuthID(authId)
+}
+
+func (s *CachedUserStore[U]) HasLegacy() bool {
+	_ = s.ensureLoaded()
+	return s.cache.HasLegacy()
+}
+
+func (s *CachedUserStore[U]) refreshLegacyKeys() {
+	s.cache.refreshLegacyKeys()
+}
+
+func (s *CachedUserStore[U]) setRemoved(removed func(user U)) {
+	s.cache.setRemoved(removed)
+}
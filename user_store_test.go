@@ -0,0 +1,167 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/sagernet/sing/common/buf"
+)
+
+type testUserSource struct {
+	access  sync.Mutex
+	users   map[string][]Credential
+	err     error
+	release chan struct{}
+	loads   int
+}
+
+func (s *testUserSource) LoadUsers(ctx context.Context) (map[string][]Credential, error) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.loads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	users := make(map[string][]Credential, len(s.users))
+	for user, credentials := range s.users {
+		users[user] = credentials
+	}
+	return users, nil
+}
+
+func (s *testUserSource) LoadUser(ctx context.Context, user string) ([]Credential, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.users[user], s.err
+}
+
+func (s *testUserSource) set(user string, credentials []Credential, err error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if credentials == nil {
+		delete(s.users, user)
+	} else {
+		s.users[user] = credentials
+	}
+	s.err = err
+}
+
+func (s *testUserSource) loadCount() int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.loads
+}
+
+func testMatchAuthID(store UserStore[string], userId string) (UserKey[string], bool, error) {
+	buffer := buf.NewSize(16)
+	defer buffer.Release()
+	AuthID(Key(uuid.FromStringOrNil(userId)), time.Now(), buffer)
+	var decodedId [16]byte
+	return store.MatchAuthID(buffer.Bytes(), &decodedId)
+}
+
+func TestCachedUserStoreBackgroundLoad(t *testing.T) {
+	t.Parallel()
+	source := &testUserSource{
+		users:   map[string][]Credential{"test": {{UUID: testUserID}}},
+		release: make(chan struct{}),
+	}
+	store := NewCachedUserStore[string](source, CachedUserStoreOptions{})
+	done := make(chan struct{})
+	go func() {
+		testMatchAuthID(store, testUserID)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handshake blocked by the first load")
+	}
+	close(source.release)
+	waitFor(t, func() bool {
+		key, found, err := testMatchAuthID(store, testUserID)
+		return err == nil && found && key.User == "test"
+	}, "user not loaded in the background")
+}
+
+func TestCachedUserStoreRetry(t *testing.T) {
+	t.Parallel()
+	clock := &testClock{now: time.Now()}
+	source := &testUserSource{
+		users: map[string][]Credential{"test": {{UUID: testUserID}}},
+		err:   errors.New("database down"),
+	}
+	store := NewCachedUserStore[string](source, CachedUserStoreOptions{RetryInterval: time.Minute, TimeFunc: clock.Now})
+	testMatchAuthID(store, testUserID)
+	waitFor(t, func() bool {
+		return source.loadCount() == 1
+	}, "first load not started")
+	source.set("test", []Credential{{UUID: testUserID}}, nil)
+	for i := 0; i < 10; i++ {
+		_, found, err := testMatchAuthID(store, testUserID)
+		if found || !errors.Is(err, ErrUserStore) {
+			t.Fatal("expected a store failure before the first load succeeded, got ", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if source.loadCount() != 1 {
+		t.Fatal("failed load retried before the retry interval: ", source.loadCount())
+	}
+	clock.Add(time.Minute)
+	waitFor(t, func() bool {
+		_, found, _ := testMatchAuthID(store, testUserID)
+		return found
+	}, "failed load not retried")
+}
+
+func TestCachedUserStoreRemoval(t *testing.T) {
+	t.Parallel()
+	source := &testUserSource{
+		users: map[string][]Credential{"test": {{UUID: testUserID}}},
+	}
+	store := NewCachedUserStore[string](source, CachedUserStoreOptions{})
+	err := store.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewService[string](testEchoHandler{})
+	service.SetUserStore(store)
+	address := startTestServer(t, service)
+	conn := dialTestConn(t, address)
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	source.set("test", nil, nil)
+	err = store.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection of a user removed by Reload still open")
+	}
+
+	source.set("test", []Credential{{UUID: testUserID}}, nil)
+	err = store.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = dialTestConn(t, address)
+	defer conn.Close()
+	testMuxEcho(t, conn)
+	source.set("test", nil, nil)
+	err = store.Invalidate(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection of a user removed by Invalidate still open")
+	}
+}
@@ -88,6 +88,16 @@ func (c *Client) DialEarlyXUDPPacketConn(conn net.Conn, destination M.Socksaddr)
 	return vmess.NewXUDPConn(protocolConn, destination), common.Error(remoteConn.Write(nil))
 }
 
+// DialMuxConn returns a Mux.Cool connection for a vmess.MuxClient.
+func (c *Client) DialMuxConn(conn net.Conn) (net.Conn, error) {
+	remoteConn := NewConn(conn, c.key, vmess.CommandMux, M.Socksaddr{}, c.flow)
+	protocolConn, err := c.prepareConn(remoteConn, conn)
+	if err != nil {
+		return nil, err
+	}
+	return protocolConn, common.Error(remoteConn.Write(nil))
+}
+
 var (
 	_ N.EarlyConn        = (*Conn)(nil)
 	_ N.VectorisedWriter = (*Conn)(nil)
@@ -0,0 +1,89 @@
+package vless
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/sagernet/sing-vmess"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Fallback routes connections that are not valid VLESS requests.
+type Fallback struct {
+	// Path matches the path of an HTTP/1 request line, empty matches any request.
+	Path    string
+	Handler vmess.FallbackHandler
+}
+
+func selectFallback(fallbacks []Fallback, header []byte) vmess.FallbackHandler {
+	path := httpRequestPath(header)
+	var defaultHandler vmess.FallbackHandler
+	for _, fallback := range fallbacks {
+		if fallback.Path == "" {
+			if defaultHandler == nil {
+				defaultHandler = fallback.Handler
+			}
+		} else if path != "" && fallback.Path == path {
+			return fallback.Handler
+		}
+	}
+	return defaultHandler
+}
+
+func httpRequestPath(header []byte) string {
+	lineEnd := bytes.IndexByte(header, '\n')
+	if lineEnd < 0 {
+		lineEnd = len(header)
+	}
+	fields := bytes.Fields(header[:lineEnd])
+	if len(fields) < 2 || len(fields[1]) == 0 || fields[1][0] != '/' {
+		return ""
+	}
+	path := fields[1]
+	if queryIndex := bytes.IndexAny(path, "?#"); queryIndex >= 0 {
+		path = path[:queryIndex]
+	}
+	return string(path)
+}
+
+func (s *Service[T]) fallbackConnection(ctx context.Context, conn net.Conn, requestBuffer *buf.Buffer, source M.Socksaddr, onClose N.CloseHandlerFunc, cause error) error {
+	handler := selectFallback(s.fallbacks, requestBuffer.Bytes())
+	if handler == nil {
+		return cause
+	}
+	handler.NewFallbackConnectionEx(ctx, bufio.NewCachedConn(conn, requestBuffer.ToOwned()), source, onClose)
+	return nil
+}
+
+// recordReader keeps a copy of everything read from upstream, so the request can be replayed to a fallback.
+type recordReader struct {
+	upstream net.Conn
+	record   *buf.Buffer
+	offset   int
+}
+
+func (r *recordReader) Read(p []byte) (n int, err error) {
+	if r.offset < r.record.Len() {
+		n = copy(p, r.record.From(r.offset))
+		r.offset += n
+		return
+	}
+	n, err = r.upstream.Read(p)
+	if n > 0 {
+		_, _ = r.record.Write(p[:n])
+		r.offset += n
+	}
+	return
+}
+
+// remaining returns a conn that starts with the recorded bytes not consumed yet.
+func (r *recordReader) remaining() net.Conn {
+	if r.offset == r.record.Len() {
+		return r.upstream
+	}
+	return bufio.NewCachedConn(r.upstream, buf.As(r.record.From(r.offset)).ToOwned())
+}
@@ -3,6 +3,7 @@ package vless
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 
@@ -14,15 +15,22 @@ import (
 	"github.com/sagernet/sing/common/logger"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
-
-	"github.com/gofrs/uuid/v5"
 )
 
 type Service[T comparable] struct {
-	userMap  map[[16]byte]T
-	userFlow map[T]string
-	logger   logger.Logger
-	handler  Handler
+	users        *MemoryUserStore[T]
+	store        UserStore[T]
+	conns        vmess.ConnTracker[T]
+	stats        vmess.StatsCounter[T]
+	hook         vmess.RequestHook[T]
+	limiter      *vmess.RateLimiter[T]
+	quota        *vmess.QuotaManager[T]
+	guard        *vmess.ProbeGuard
+	muxPolicy    vmess.MuxPolicy
+	streamReject func(err *vmess.RejectError)
+	fallbacks    []Fallback
+	logger       logger.Logger
+	handler      Handler
 }
 
 type Handler interface {
@@ -31,69 +39,293 @@ type Handler interface {
 }
 
 func NewService[T comparable](logger logger.Logger, handler Handler) *Service[T] {
-	return &Service[T]{
+	service := &Service[T]{
+		users:   NewMemoryUserStore[T](),
 		logger:  logger,
 		handler: handler,
 	}
+	service.SetUserStore(service.users)
+	return service
 }
 
+// UpdateUsers replaces the users of the built-in store, like the other user methods of Service
+// it has no effect on requests if an external store is set.
 func (s *Service[T]) UpdateUsers(userList []T, userUUIDList []string, userFlowList []string) {
-	userMap := make(map[[16]byte]T)
-	userFlowMap := make(map[T]string)
-	for i, userName := range userList {
-		userID, err := uuid.FromString(userUUIDList[i])
-		if err != nil {
-			userID = uuid.NewV5(uuid.Nil, userUUIDList[i])
-		}
-		userMap[userID] = userName
-		userFlowMap[userName] = userFlowList[i]
+	s.users.UpdateUsers(userList, userUUIDList, userFlowList)
+}
+
+func (s *Service[T]) AddUser(user T, userUUID string, userFlow string) error {
+	return s.users.AddUser(user, userUUID, userFlow)
+}
+
+// ReplaceUser updates the credentials of a user, or adds it if it does not exist.
+func (s *Service[T]) ReplaceUser(user T, userUUID string, userFlow string) {
+	s.users.SetUserCredentials(user, []vmess.Credential{{UUID: userUUID}}, userFlow)
+}
+
+// SetUserCredentials replaces the credentials of a user, or adds it if it does not exist.
+// All credentials authenticate as the same user, so a UUID can be rotated by adding the new one
+// before removing the old one. Connections of the user are not closed.
+func (s *Service[T]) SetUserCredentials(user T, credentials []vmess.Credential, flow string) {
+	s.users.SetUserCredentials(user, credentials, flow)
+}
+
+func (s *Service[T]) RemoveUser(user T) {
+	s.users.RemoveUser(user)
+}
+
+// SetUserStore makes the service resolve users from store instead of the built-in store.
+// Live connections of users removed from the built-in store or a CachedUserStore are closed.
+func (s *Service[T]) SetUserStore(store UserStore[T]) {
+	s.store = store
+	if notifier, isNotifier := store.(userRemovalNotifier[T]); isNotifier {
+		notifier.setRemoved(func(user T) {
+			s.conns.CloseUser(user, vmess.ErrUserRemoved)
+		})
 	}
-	s.userMap = userMap
-	s.userFlow = userFlowMap
+}
+
+// SetFallbacks makes connections that are not valid VLESS requests, or use an unknown UUID,
+// be handed to the first fallback matching the request instead of being closed.
+func (s *Service[T]) SetFallbacks(fallbacks []Fallback) {
+	s.fallbacks = fallbacks
+}
+
+// SetStatsCounter sets the counter that receives per-user traffic and connection events.
+func (s *Service[T]) SetStatsCounter(counter vmess.StatsCounter[T]) {
+	s.stats = counter
+}
+
+// SetRequestHook sets the hook that can reject, rewrite or tag every request before it is dispatched.
+func (s *Service[T]) SetRequestHook(hook vmess.RequestHook[T]) {
+	s.hook = hook
+}
+
+// SetRateLimiter sets the limiter applied to the payload of every connection and mux stream.
+func (s *Service[T]) SetRateLimiter(limiter *vmess.RateLimiter[T]) {
+	s.limiter = limiter
+}
+
+// SetQuotaManager sets the manager that enforces user expiration and traffic quotas.
+func (s *Service[T]) SetQuotaManager(manager *vmess.QuotaManager[T]) {
+	s.quota = manager
+	if manager != nil {
+		manager.AttachTracker(&s.conns)
+	}
+}
+
+// SetProbeGuard sets the guard that bans sources sending invalid requests, banned sources
+// are rejected before authentication, or handed to the fallbacks if set.
+func (s *Service[T]) SetProbeGuard(guard *vmess.ProbeGuard) {
+	s.guard = guard
+}
+
+// SetMuxPolicy sets the policy of mux sessions.
+func (s *Service[T]) SetMuxPolicy(policy vmess.MuxPolicy) {
+	s.muxPolicy = policy
+}
+
+// SetStreamRejectHandler sets a handler that receives the RejectError of every mux stream rejected
+// by a limit, the quota or the request hook. The mux connection stays open.
+func (s *Service[T]) SetStreamRejectHandler(handler func(err *vmess.RejectError)) {
+	s.streamReject = handler
+}
+
+// SetConnLimit sets the connection limit of users without their own limit.
+func (s *Service[T]) SetConnLimit(limit vmess.ConnLimit) {
+	s.conns.SetDefaultLimit(limit)
+}
+
+// SetUserConnLimit overrides the connection limit of user, a nil limit removes the override.
+func (s *Service[T]) SetUserConnLimit(user T, limit *vmess.ConnLimit) {
+	s.conns.SetLimit(user, limit)
+}
+
+// KickUser closes all live connections and mux streams of user with vmess.ErrUserKicked,
+// and returns the number of connections closed.
+func (s *Service[T]) KickUser(user T) int {
+	return s.conns.CloseUser(user, vmess.ErrUserKicked)
 }
 
 func (s *Service[T]) NewConnection(ctx context.Context, conn net.Conn, source M.Socksaddr, onClose N.CloseHandlerFunc) error {
-	request, err := ReadRequest(conn)
-	if err != nil {
+	var (
+		request  *Request
+		user     T
+		userFlow string
+		found    bool
+		err      error
+	)
+	reject := func(stage vmess.RejectStage, reason vmess.RejectReason, cause error) error {
+		var rejectUser any
+		if found {
+			rejectUser = user
+		}
+		err := vmess.NewRejectError("vless", stage, reason, rejectUser, source, cause)
+		s.guard.Observe(err)
 		return err
 	}
-	user, loaded := s.userMap[request.UUID]
-	if !loaded {
-		return E.New("unknown UUID: ", uuid.FromBytesOrNil(request.UUID[:]))
+	if len(s.fallbacks) > 0 {
+		requestBuffer := buf.New()
+		defer requestBuffer.Release()
+		_, err = requestBuffer.ReadOnceFrom(conn)
+		if err != nil {
+			return reject(vmess.RejectStageHeader, vmess.RejectReasonConnection, err)
+		}
+		if s.guard.Banned(source) {
+			return s.fallbackConnection(ctx, conn, requestBuffer, source, onClose, reject(vmess.RejectStageAuthID, vmess.RejectReasonBanned, vmess.ErrSourceBanned))
+		}
+		reader := &recordReader{upstream: conn, record: requestBuffer}
+		request, err = ReadRequest(reader)
+		if err != nil {
+			return s.fallbackConnection(ctx, conn, requestBuffer, source, onClose, reject(vmess.RejectStageHeader, requestReason(err), err))
+		}
+		user, userFlow, err = s.store.LookupUser(ctx, request.UUID)
+		if err != nil {
+			return s.fallbackConnection(ctx, conn, requestBuffer, source, onClose, reject(vmess.RejectStageAuthID, lookupReason(err), err))
+		}
+		conn = reader.remaining()
+	} else {
+		if s.guard.Banned(source) {
+			return reject(vmess.RejectStageAuthID, vmess.RejectReasonBanned, vmess.ErrSourceBanned)
+		}
+		request, err = ReadRequest(conn)
+		if err != nil {
+			return reject(vmess.RejectStageHeader, requestReason(err), err)
+		}
+		user, userFlow, err = s.store.LookupUser(ctx, request.UUID)
+		if err != nil {
+			return reject(vmess.RejectStageAuthID, lookupReason(err), err)
+		}
+	}
+	found = true
+	err = s.quota.Check(user)
+	if err != nil {
+		return reject(vmess.RejectStageAuthID, vmess.RejectReasonQuota, err)
 	}
 	ctx = auth.ContextWithUser(ctx, user)
-	userFlow := s.userFlow[user]
 	if request.Flow == FlowVision && request.Command == vmess.NetworkUDP {
-		return E.New(FlowVision, " flow does not support UDP")
+		return reject(vmess.RejectStageHeader, vmess.RejectReasonBadFlow, E.New(FlowVision, " flow does not support UDP"))
 	} else if request.Flow != userFlow {
-		return E.New("flow mismatch: expected ", flowName(userFlow), ", but got ", flowName(request.Flow))
+		return reject(vmess.RejectStageHeader, vmess.RejectReasonBadFlow, E.New("flow mismatch: expected ", flowName(userFlow), ", but got ", flowName(request.Flow)))
 	}
 
+	trackedConn := vmess.NewTrackedConn(conn)
+	metadata := vmess.ConnMetadata{
+		Protocol:    "vless",
+		Command:     request.Command,
+		Flow:        request.Flow,
+		Source:      source,
+		Destination: request.Destination,
+	}
+	if request.Command != vmess.CommandMux {
+		ctx, request.Destination, err = s.hook.Route(ctx, user, metadata)
+		if err != nil {
+			return reject(vmess.RejectStageHeader, vmess.RejectReasonHook, err)
+		}
+		metadata.Destination = request.Destination
+	}
 	if request.Command == vmess.CommandUDP {
-		s.handler.NewPacketConnectionEx(ctx, &serverPacketConn{ExtendedConn: bufio.NewExtendedConn(conn), destination: request.Destination}, source, request.Destination, onClose)
+		connStats, err := s.trackConn(user, trackedConn, source, metadata)
+		if err != nil {
+			return reject(vmess.RejectStageHeader, vmess.RejectReasonLimit, err)
+		}
+		s.handler.NewPacketConnectionEx(ctx, s.wrapPacketConn(user, connStats.WrapPacketConn(&serverPacketConn{ExtendedConn: bufio.NewExtendedConn(trackedConn), destination: request.Destination})), source, request.Destination, onClose)
 		return nil
 	}
-	responseConn := &serverConn{ExtendedConn: bufio.NewExtendedConn(conn), writer: bufio.NewVectorisedWriter(conn)}
+	responseConn := &serverConn{ExtendedConn: bufio.NewExtendedConn(trackedConn), writer: bufio.NewVectorisedWriter(trackedConn)}
 	switch userFlow {
 	case FlowVision:
 		conn, err = NewVisionConn(responseConn, conn, request.UUID, s.logger)
 		if err != nil {
-			return E.Cause(err, "initialize vision")
+			return reject(vmess.RejectStageHeader, vmess.RejectReasonBadFlow, E.Cause(err, "initialize vision"))
 		}
 	case "":
 		conn = responseConn
 	default:
-		return E.New("unknown flow: ", userFlow)
+		return reject(vmess.RejectStageHeader, vmess.RejectReasonBadFlow, E.New("unknown flow: ", userFlow))
 	}
 	switch request.Command {
 	case vmess.CommandTCP:
-		s.handler.NewConnectionEx(ctx, conn, source, request.Destination, onClose)
+		connStats, err := s.trackConn(user, trackedConn, source, metadata)
+		if err != nil {
+			return reject(vmess.RejectStageHeader, vmess.RejectReasonLimit, err)
+		}
+		s.handler.NewConnectionEx(ctx, s.wrapConn(user, connStats.WrapConn(conn)), source, request.Destination, onClose)
 		return nil
 	case vmess.CommandMux:
-		return vmess.HandleMuxConnection(ctx, conn, source, s.handler)
+		s.limiter.LimitMuxConn(user, trackedConn)
+		_, err = s.trackConn(user, trackedConn, source, metadata)
+		if err != nil {
+			return reject(vmess.RejectStageHeader, vmess.RejectReasonLimit, err)
+		}
+		defer trackedConn.Close()
+		return vmess.HandleMuxConnectionEx(ctx, conn, source, s.handler, vmess.MuxServerOptions{
+			TrackStream: func(closer func(err error)) (func(), error) {
+				return s.conns.TrackStream(user, closer)
+			},
+			RouteStream: func(ctx context.Context, command byte, destination M.Socksaddr) (context.Context, M.Socksaddr, error) {
+				err := s.quota.Check(user)
+				if err != nil {
+					return nil, M.Socksaddr{}, err
+				}
+				return s.hook.Route(ctx, user, metadata.ForMuxStream(command, destination))
+			},
+			StreamStats: func(command byte, destination M.Socksaddr) *vmess.ConnStats {
+				return vmess.NewConnStats(s.stats, user, metadata.ForMuxStream(command, destination))
+			},
+			WrapConn: func(conn net.Conn) net.Conn {
+				return s.quota.WrapConn(user, s.limiter.WrapMuxStream(user, conn))
+			},
+			WrapPacketConn: func(conn N.PacketConn) N.PacketConn {
+				return s.quota.WrapPacketConn(user, s.limiter.WrapMuxPacketStream(user, conn))
+			},
+			RejectStream: func(err *vmess.RejectError) {
+				if s.streamReject != nil {
+					err.User = user
+					s.streamReject(err)
+				}
+			},
+			MuxPolicy: s.muxPolicy,
+		})
 	default:
-		return E.New("unknown command: ", request.Command)
+		return reject(vmess.RejectStageHeader, vmess.RejectReasonBadCommand, E.New("unknown command: ", request.Command))
+	}
+}
+
+// trackConn starts counting the traffic of conn, then tracks it.
+func (s *Service[T]) trackConn(user T, conn *vmess.TrackedConn, source M.Socksaddr, metadata vmess.ConnMetadata) (*vmess.ConnStats, error) {
+	connStats := vmess.NewConnStats(s.stats, user, metadata)
+	conn.SetStats(connStats)
+	err := s.conns.TrackConn(user, conn, source)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return connStats, nil
+}
+
+func (s *Service[T]) wrapConn(user T, conn net.Conn) net.Conn {
+	return s.quota.WrapConn(user, s.limiter.WrapConn(user, conn))
+}
+
+func (s *Service[T]) wrapPacketConn(user T, conn N.PacketConn) N.PacketConn {
+	return s.quota.WrapPacketConn(user, s.limiter.WrapPacketConn(user, conn))
+}
+
+// requestReason tells transport errors apart from malformed requests.
+func requestReason(err error) vmess.RejectReason {
+	if E.IsClosed(err) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return vmess.RejectReasonConnection
+	}
+	return vmess.RejectReasonBadHeader
+}
+
+// lookupReason tells unknown UUIDs apart from failures of the user store.
+func lookupReason(err error) vmess.RejectReason {
+	if errors.Is(err, ErrUnknownUser) {
+		return vmess.RejectReasonUnknownUser
 	}
+	return vmess.RejectReasonUserStore
 }
 
 func flowName(value string) string {
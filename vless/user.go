@@ -0,0 +1,102 @@
+package vless
+
+import (
+	"time"
+
+	"github.com/sagernet/sing-vmess"
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// userTable is an immutable snapshot of the configured users.
+// Writers build a new table and publish it atomically, readers never lock.
+type userTable[T comparable] struct {
+	userMap  map[[16]byte]userCredential[T]
+	userFlow map[T]string
+	userUUID map[T][][16]byte
+}
+
+type userCredential[T comparable] struct {
+	user       T
+	credential vmess.Credential
+}
+
+func newUserTable[T comparable](size int) *userTable[T] {
+	return &userTable[T]{
+		userMap:  make(map[[16]byte]userCredential[T], size),
+		userFlow: make(map[T]string, size),
+		userUUID: make(map[T][][16]byte, size),
+	}
+}
+
+func (t *userTable[T]) clone() *userTable[T] {
+	if t == nil {
+		return newUserTable[T](0)
+	}
+	newTable := newUserTable[T](len(t.userFlow) + 1)
+	for userID, user := range t.userMap {
+		newTable.userMap[userID] = user
+	}
+	for user, flow := range t.userFlow {
+		newTable.userFlow[user] = flow
+	}
+	for user, userIDs := range t.userUUID {
+		newTable.userUUID[user] = userIDs
+	}
+	return newTable
+}
+
+func (t *userTable[T]) put(user T, credentials []vmess.Credential, flow string) {
+	t.remove(user)
+	userIDs := make([][16]byte, 0, len(credentials))
+	for _, credential := range credentials {
+		userID, err := uuid.FromString(credential.UUID)
+		if err != nil {
+			userID = uuid.NewV5(uuid.Nil, credential.UUID)
+		}
+		t.userMap[userID] = userCredential[T]{user, credential}
+		userIDs = append(userIDs, userID)
+	}
+	t.userFlow[user] = flow
+	t.userUUID[user] = userIDs
+}
+
+func (t *userTable[T]) remove(user T) bool {
+	userIDs, loaded := t.userUUID[user]
+	if !loaded {
+		return false
+	}
+	for _, userID := range userIDs {
+		if t.userMap[userID].user == user {
+			delete(t.userMap, userID)
+		}
+	}
+	delete(t.userFlow, user)
+	delete(t.userUUID, user)
+	return true
+}
+
+// authenticate returns the user and flow of userID if its credential is active at now.
+func (t *userTable[T]) authenticate(userID [16]byte, now time.Time) (T, string, error) {
+	if t == nil {
+		return common.DefaultValue[T](), "", E.Extend(ErrUnknownUser, uuid.FromBytesOrNil(userID[:]))
+	}
+	user, loaded := t.userMap[userID]
+	if !loaded {
+		return common.DefaultValue[T](), "", E.Extend(ErrUnknownUser, uuid.FromBytesOrNil(userID[:]))
+	}
+	if !user.credential.Active(now) {
+		return common.DefaultValue[T](), "", vmess.ErrCredentialInactive
+	}
+	return user.user, t.userFlow[user.user], nil
+}
+
+func (t *userTable[T]) contains(user T) bool {
+	if t == nil {
+		return false
+	}
+	_, loaded := t.userUUID[user]
+	return loaded
+}
@@ -0,0 +1,278 @@
+package vless
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-vmess"
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var (
+	ErrUnknownUser = E.New("unknown UUID")
+	// ErrUserStore wraps the errors of stores that fail to look up a user.
+	ErrUserStore = E.New("user store failure")
+)
+
+// UserStore resolves the users of VLESS requests.
+type UserStore[T comparable] interface {
+	// LookupUser returns the user and flow of the active credential userID. The error wraps
+	// ErrUnknownUser if no user has userID, other errors are reported as store failures.
+	LookupUser(ctx context.Context, userID [16]byte) (user T, flow string, err error)
+}
+
+// userRemovalNotifier is implemented by stores that can report removed users to the service.
+type userRemovalNotifier[T comparable] interface {
+	setRemoved(removed func(user T))
+}
+
+var _ UserStore[string] = (*MemoryUserStore[string])(nil)
+
+// MemoryUserStore keeps all users in memory, it is the default store of Service.
+type MemoryUserStore[T comparable] struct {
+	users      atomic.Pointer[userTable[T]]
+	userAccess sync.Mutex
+	removed    func(user T)
+}
+
+func NewMemoryUserStore[T comparable]() *MemoryUserStore[T] {
+	return &MemoryUserStore[T]{}
+}
+
+func (s *MemoryUserStore[T]) UpdateUsers(userList []T, userUUIDList []string, userFlowList []string) {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	users := newUserTable[T](len(userList))
+	for i, userName := range userList {
+		users.put(userName, []vmess.Credential{{UUID: userUUIDList[i]}}, userFlowList[i])
+	}
+	oldUsers := s.users.Swap(users)
+	if oldUsers != nil && s.removed != nil {
+		for user := range oldUsers.userUUID {
+			if !users.contains(user) {
+				s.removed(user)
+			}
+		}
+	}
+}
+
+func (s *MemoryUserStore[T]) AddUser(user T, userUUID string, userFlow string) error {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	oldUsers := s.users.Load()
+	if oldUsers.contains(user) {
+		return E.New("user already exists: ", user)
+	}
+	users := oldUsers.clone()
+	users.put(user, []vmess.Credential{{UUID: userUUID}}, userFlow)
+	s.users.Store(users)
+	return nil
+}
+
+// SetUserCredentials replaces the credentials of a user, or adds it if it does not exist.
+func (s *MemoryUserStore[T]) SetUserCredentials(user T, credentials []vmess.Credential, flow string) {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	users := s.users.Load().clone()
+	users.put(user, credentials, flow)
+	s.users.Store(users)
+}
+
+func (s *MemoryUserStore[T]) RemoveUser(user T) {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	oldUsers := s.users.Load()
+	if !oldUsers.contains(user) {
+		return
+	}
+	users := oldUsers.clone()
+	users.remove(user)
+	s.users.Store(users)
+	if s.removed != nil {
+		s.removed(user)
+	}
+}
+
+func (s *MemoryUserStore[T]) LookupUser(ctx context.Context, userID [16]byte) (T, string, error) {
+	return s.users.Load().authenticate(userID, time.Now())
+}
+
+func (s *MemoryUserStore[T]) setRemoved(removed func(user T)) {
+	s.userAccess.Lock()
+	defer s.userAccess.Unlock()
+	s.removed = removed
+}
+
+// UserRecord is a credential of a user loaded by a UserLoader.
+type UserRecord[T comparable] struct {
+	User       T
+	Flow       string
+	Credential vmess.Credential
+}
+
+// UserLoader loads users for a CachedUserStore, usually from a database.
+type UserLoader[T comparable] interface {
+	// LoadUser returns the user of userID, or nil if there is none.
+	LoadUser(ctx context.Context, userID [16]byte) (*UserRecord[T], error)
+}
+
+type CachedUserStoreOptions struct {
+	// TTL is how long a loaded user is cached, the default is one minute.
+	TTL time.Duration
+	// NegativeTTL is how long an unknown UUID is cached, the default is TTL.
+	NegativeTTL time.Duration
+	// MaxEntries limits the cached users, the default is 65536.
+	MaxEntries int
+	// MaxNegativeEntries limits the cached unknown UUIDs, the default is 4096.
+	// They are kept apart from users, so scanning random UUIDs does not evict users.
+	MaxNegativeEntries int
+}
+
+var _ UserStore[string] = (*CachedUserStore[string])(nil)
+
+// CachedUserStore loads users by UUID when they connect and caches them.
+// If a cached UUID is gone when it is reloaded, live connections of its user are closed,
+// unless another cached UUID still belongs to the user.
+type CachedUserStore[T comparable] struct {
+	loader   UserLoader[T]
+	options  CachedUserStoreOptions
+	access   sync.RWMutex
+	cache    map[[16]byte]cachedUser[T]
+	negative map[[16]byte]time.Time
+	removed  func(user T)
+}
+
+type cachedUser[T comparable] struct {
+	record   *UserRecord[T]
+	expireAt time.Time
+}
+
+func NewCachedUserStore[T comparable](loader UserLoader[T], options CachedUserStoreOptions) *CachedUserStore[T] {
+	if options.TTL <= 0 {
+		options.TTL = time.Minute
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = options.TTL
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = 65536
+	}
+	if options.MaxNegativeEntries <= 0 {
+		options.MaxNegativeEntries = 4096
+	}
+	return &CachedUserStore[T]{
+		loader:   loader,
+		options:  options,
+		cache:    make(map[[16]byte]cachedUser[T]),
+		negative: make(map[[16]byte]time.Time),
+	}
+}
+
+func (s *CachedUserStore[T]) LookupUser(ctx context.Context, userID [16]byte) (T, string, error) {
+	now := time.Now()
+	s.access.RLock()
+	cached, loaded := s.cache[userID]
+	if !loaded {
+		cached.expireAt, loaded = s.negative[userID]
+	}
+	s.access.RUnlock()
+	if !loaded || now.After(cached.expireAt) {
+		var err error
+		cached, err = s.load(ctx, userID, cached.record, now)
+		if err != nil {
+			return common.DefaultValue[T](), "", err
+		}
+	}
+	if cached.record == nil {
+		return common.DefaultValue[T](), "", E.Extend(ErrUnknownUser, uuid.FromBytesOrNil(userID[:]))
+	}
+	if !cached.record.Credential.Active(now) {
+		return common.DefaultValue[T](), "", vmess.ErrCredentialInactive
+	}
+	return cached.record.User, cached.record.Flow, nil
+}
+
+// load loads userID from the loader and caches the result, previous is the record cached before.
+func (s *CachedUserStore[T]) load(ctx context.Context, userID [16]byte, previous *UserRecord[T], now time.Time) (cachedUser[T], error) {
+	record, err := s.loader.LoadUser(ctx, userID)
+	if err != nil {
+		return cachedUser[T]{}, E.Cause1(ErrUserStore, err)
+	}
+	cached := cachedUser[T]{record: record}
+	if record != nil {
+		cached.expireAt = now.Add(s.options.TTL)
+		s.store(userID, cached, now)
+	} else {
+		cached.expireAt = now.Add(s.options.NegativeTTL)
+		s.storeNegative(userID, cached.expireAt, now)
+	}
+	if previous != nil && (record == nil || record.User != previous.User) {
+		s.access.RLock()
+		removed := s.removed
+		for _, other := range s.cache {
+			if other.record.User == previous.User {
+				removed = nil
+				break
+			}
+		}
+		s.access.RUnlock()
+		if removed != nil {
+			removed(previous.User)
+		}
+	}
+	return cached, nil
+}
+
+func (s *CachedUserStore[T]) store(userID [16]byte, cached cachedUser[T], now time.Time) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if len(s.cache) >= s.options.MaxEntries {
+		for cachedID, other := range s.cache {
+			if now.After(other.expireAt) {
+				delete(s.cache, cachedID)
+			}
+		}
+		if len(s.cache) >= s.options.MaxEntries {
+			s.cache = make(map[[16]byte]cachedUser[T])
+		}
+	}
+	delete(s.negative, userID)
+	s.cache[userID] = cached
+}
+
+func (s *CachedUserStore[T]) storeNegative(userID [16]byte, expireAt time.Time, now time.Time) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if len(s.negative) >= s.options.MaxNegativeEntries {
+		for cachedID, otherExpireAt := range s.negative {
+			if now.After(otherExpireAt) {
+				delete(s.negative, cachedID)
+			}
+		}
+		if len(s.negative) >= s.options.MaxNegativeEntries {
+			s.negative = make(map[[16]byte]time.Time)
+		}
+	}
+	delete(s.cache, userID)
+	s.negative[userID] = expireAt
+}
+
+// Invalidate reloads the user of userID from the loader.
+func (s *CachedUserStore[T]) Invalidate(ctx context.Context, userID [16]byte) error {
+	s.access.RLock()
+	cached := s.cache[userID]
+	s.access.RUnlock()
+	_, err := s.load(ctx, userID, cached.record, time.Now())
+	return err
+}
+
+func (s *CachedUserStore[T]) setRemoved(removed func(user T)) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.removed = removed
+}
@@ -0,0 +1,87 @@
+package vless
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-vmess"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+type testUserLoader struct {
+	access  sync.Mutex
+	records map[[16]byte]*UserRecord[string]
+	err     error
+}
+
+func (l *testUserLoader) LoadUser(ctx context.Context, userID [16]byte) (*UserRecord[string], error) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	return l.records[userID], l.err
+}
+
+func (l *testUserLoader) set(userID [16]byte, record *UserRecord[string], err error) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if record == nil {
+		delete(l.records, userID)
+	} else {
+		l.records[userID] = record
+	}
+	l.err = err
+}
+
+func TestCachedUserStore(t *testing.T) {
+	t.Parallel()
+	first := uuid.Must(uuid.NewV4())
+	second := uuid.Must(uuid.NewV4())
+	loader := &testUserLoader{records: map[[16]byte]*UserRecord[string]{
+		first:  {User: "test", Credential: vmess.Credential{UUID: first.String()}},
+		second: {User: "test", Credential: vmess.Credential{UUID: second.String()}},
+	}}
+	store := NewCachedUserStore[string](loader, CachedUserStoreOptions{})
+	var removed []string
+	store.setRemoved(func(user string) {
+		removed = append(removed, user)
+	})
+	for _, userID := range [][16]byte{first, second} {
+		user, _, err := store.LookupUser(context.Background(), userID)
+		if err != nil || user != "test" {
+			t.Fatal("lookup failed: ", user, " ", err)
+		}
+	}
+	_, _, err := store.LookupUser(context.Background(), uuid.Must(uuid.NewV4()))
+	if !errors.Is(err, ErrUnknownUser) || errors.Is(err, ErrUserStore) {
+		t.Fatal("expected an unknown user, got ", err)
+	}
+
+	loader.set(first, nil, errors.New("database down"))
+	err = store.Invalidate(context.Background(), first)
+	if !errors.Is(err, ErrUserStore) {
+		t.Fatal("expected a store failure, got ", err)
+	}
+
+	loader.set(first, nil, nil)
+	err = store.Invalidate(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Fatal("reported a user with another UUID as removed")
+	}
+	loader.set(second, nil, nil)
+	err = store.Invalidate(context.Background(), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "test" {
+		t.Fatal("removed user not reported: ", removed)
+	}
+	_, _, err = store.LookupUser(context.Background(), second)
+	if !errors.Is(err, ErrUnknownUser) {
+		t.Fatal("expected an unknown user after removal, got ", err)
+	}
+}